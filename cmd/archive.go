@@ -0,0 +1,44 @@
+// Copyright © 2018 ThreeComma.io <hello@threecomma.io>
+
+package cmd
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/threecommaio/snappy/pkg/snappy"
+)
+
+func init() {
+	commitlogCmd.AddCommand(archiveCmd)
+
+	addThrottleFlags(archiveCmd, 200)
+	addEncryptionFlags(archiveCmd)
+	addStorageFlags(archiveCmd)
+}
+
+// archiveCmd represents the commitlog archive command
+var archiveCmd = &cobra.Command{
+	Use:   "archive [segment-path] [segment-name]",
+	Short: "Upload a commit log segment, for use as archive_command in commitlog_archiving.properties",
+	Long: `Upload a commit log segment, for use as archive_command in commitlog_archiving.properties:
+
+  archive_command=/usr/local/bin/snappy commitlog archive %path %name -u s3://bucket/prefix`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := storageConfig(cmd)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := applyThrottle(cmd); err != nil {
+			log.Fatal(err)
+		}
+
+		keyring, err := loadKeyring(cmd)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := snappy.ArchiveCommitlog(config, args[0], args[1], keyring); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
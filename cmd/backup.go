@@ -3,6 +3,7 @@
 package cmd
 
 import (
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/threecommaio/snappy/pkg/snappy"
 )
@@ -10,17 +11,81 @@ import (
 // backupCmd represents the backup command
 var backupCmd = &cobra.Command{
 	Use:   "backup",
-	Short: "Creates a snapshot and uploads to an S3 bucket",
+	Short: "Creates a snapshot and uploads to a backup destination",
 	Run: func(cmd *cobra.Command, args []string) {
 		var (
-			region, _     = cmd.Flags().GetString("aws-region")
-			bucket, _     = cmd.Flags().GetString("aws-s3-bucket")
-			throttle, _   = cmd.Flags().GetInt("throttle")
-			snapshotID, _ = cmd.Flags().GetString("snapshot-id")
-			keyspaces, _  = cmd.Flags().GetStringSlice("keyspaces")
-			config        = &snappy.AWSConfig{Bucket: bucket, Region: region, Throttle: throttle}
+			snapshotID, _  = cmd.Flags().GetString("snapshot-id")
+			keyspaces, _   = cmd.Flags().GetStringSlice("keyspaces")
+			class, _       = cmd.Flags().GetString("storage-class")
+			incremental, _ = cmd.Flags().GetBool("incremental")
+			base, _        = cmd.Flags().GetString("base")
+			dedup, _       = cmd.Flags().GetBool("dedup")
+			parallel, _    = cmd.Flags().GetInt("parallel")
+			codec, _       = cmd.Flags().GetString("compression")
+			level, _       = cmd.Flags().GetInt("compression-level")
+			smart, _       = cmd.Flags().GetBool("smart-compression")
+			keepLocal, _   = cmd.Flags().GetBool("keep-local")
+			keepLast, _    = cmd.Flags().GetInt("keep-last")
+			labels, _      = cmd.Flags().GetStringSlice("label")
 		)
-		snappy.Backup(config, snapshotID, keyspaces)
+		if keepLast < 0 {
+			log.Fatal("--keep-last cannot be negative")
+		}
+		if parallel < 1 {
+			log.Fatal("--parallel must be at least 1")
+		}
+		configs, err := storageConfigs(cmd)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, config := range configs {
+			config.StorageClass = class
+		}
+		if err := applyThrottle(cmd); err != nil {
+			log.Fatal(err)
+		}
+
+		options := &snappy.BackupOptions{
+			Keyspaces:        keyspaces,
+			Dedup:            dedup,
+			Parallel:         parallel,
+			Compression:      snappy.Compression{Codec: codec, Level: level},
+			SmartCompression: smart,
+			KeepLocal:        keepLocal,
+			KeepLast:         keepLast,
+			Labels:           make(map[string]string),
+		}
+		for _, label := range labels {
+			key, value := snappy.Split(label, "=")
+			if key == "" {
+				log.Fatalf("invalid --label [%s], expected key=value", label)
+			}
+			options.Labels[key] = value
+		}
+		if err := options.Compression.Validate(); err != nil {
+			log.Fatal(err)
+		}
+		if options.Keyring, err = loadKeyring(cmd); err != nil {
+			log.Fatal(err)
+		}
+		if dedup && options.Keyring != nil {
+			if err := options.Keyring.ValidateDedup(); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if incremental {
+			if base == "" {
+				log.Fatal("--incremental requires the --base snapshot id")
+			}
+			if err := snappy.BackupIncremental(configs, snapshotID, base, options); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+
+		if err := snappy.Backup(configs, snapshotID, options); err != nil {
+			log.Fatal(err)
+		}
 	},
 }
 
@@ -28,12 +93,22 @@ func init() {
 	rootCmd.AddCommand(backupCmd)
 
 	backupCmd.Flags().StringP("snapshot-id", "s", "", "snapshot id")
-	backupCmd.Flags().StringP("aws-region", "r", "", "the aws region to use")
-	backupCmd.Flags().StringP("aws-s3-bucket", "b", "", "the aws s3 bucket to use")
-	backupCmd.Flags().IntP("throttle", "t", 200, "throttle in megabits/s")
 	backupCmd.Flags().StringSliceP("keyspaces", "k", []string{}, "include only these keyspaces")
+	backupCmd.Flags().Bool("incremental", false, "upload sstables from the incremental backups directories instead of taking a snapshot")
+	backupCmd.Flags().String("base", "", "snapshot id an incremental backup builds on")
+	backupCmd.Flags().Bool("dedup", false, "store files once under their checksum and share them between snapshots")
+	backupCmd.Flags().IntP("parallel", "p", 4, "number of files uploaded at the same time")
+	backupCmd.Flags().Bool("keep-local", false, "keep the local snapshot after it was uploaded instead of clearing it")
+	backupCmd.Flags().Int("keep-last", 0, "keep the newest N local snapshots taken by snappy and clear the older ones")
+	backupCmd.Flags().String("compression", "", "compress files while they are uploaded (zstd, lz4)")
+	backupCmd.Flags().Int("compression-level", 0, "compression level, zstd 1-22 or lz4 1-9, 0 uses the default of the codec")
+	backupCmd.Flags().Bool("smart-compression", false, "upload the data files of tables Cassandra already compresses as they are")
+	backupCmd.Flags().StringSlice("label", nil, "label the backup with key=value, shown by list, repeat for several labels")
+	backupCmd.Flags().String("storage-class", "", "storage class for uploaded files, an S3 or GCS storage class or an Azure access tier (STANDARD_IA, DEEP_ARCHIVE, COLDLINE, Cool...)")
+	addThrottleFlags(backupCmd, 200)
+	addEncryptionFlags(backupCmd)
+	addStorageFlags(backupCmd)
+	backupCmd.Flags().Lookup("destination").Usage += ", repeat to write to several destinations"
 
 	backupCmd.MarkFlagRequired("snapshot-id")
-	backupCmd.MarkFlagRequired("aws-region")
-	backupCmd.MarkFlagRequired("aws-s3-bucket")
 }
@@ -0,0 +1,17 @@
+// Copyright © 2018 ThreeComma.io <hello@threecomma.io>
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// commitlogCmd represents the commitlog command
+var commitlogCmd = &cobra.Command{
+	Use:   "commitlog",
+	Short: "Archives commit log segments for point in time recovery",
+}
+
+func init() {
+	rootCmd.AddCommand(commitlogCmd)
+}
@@ -0,0 +1,57 @@
+// Copyright © 2018 ThreeComma.io <hello@threecomma.io>
+
+package cmd
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/threecommaio/snappy/pkg/snappy"
+)
+
+// copyCmd represents the copy command
+var copyCmd = &cobra.Command{
+	Use:   "copy",
+	Short: "Copies a completed snapshot to another bucket, region or backend",
+	Long: `Copies a completed snapshot to another bucket, region or backend.
+
+An incremental backup is copied together with its base snapshot and the earlier
+incremental backups of its chain the destination does not hold yet. Files already
+on the destination with the same size and checksum are skipped.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			source, _     = cmd.Flags().GetString("source")
+			snapshotID, _ = cmd.Flags().GetString("snapshot-id")
+			nodes, _      = cmd.Flags().GetStringSlice("nodes")
+			force, _      = cmd.Flags().GetBool("force")
+			class, _      = cmd.Flags().GetString("storage-class")
+		)
+		dst, err := storageConfig(cmd)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dst.StorageClass = class
+		if err := applyThrottle(cmd); err != nil {
+			log.Fatal(err)
+		}
+		src := newStorageConfig(cmd, source)
+
+		if err := snappy.CopySnapshot(src, dst, snapshotID, nodes, force); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(copyCmd)
+
+	copyCmd.Flags().StringP("snapshot-id", "s", "", "snapshot id")
+	copyCmd.Flags().String("source", "", "the url of the destination holding the snapshot")
+	copyCmd.Flags().StringSliceP("nodes", "n", []string{}, "copy only these nodes")
+	copyCmd.Flags().BoolP("force", "f", false, "copy snapshots that were not completely uploaded")
+	copyCmd.Flags().String("storage-class", "", "storage class for copied files, e.g. to move old snapshots to DEEP_ARCHIVE, ARCHIVE or Archive")
+	addThrottleFlags(copyCmd, 0)
+	addStorageFlags(copyCmd)
+
+	copyCmd.MarkFlagRequired("snapshot-id")
+	copyCmd.MarkFlagRequired("source")
+}
@@ -5,6 +5,7 @@ package cmd
 import (
 	"encoding/json"
 	"io/ioutil"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -15,16 +16,20 @@ func init() {
 	restoreCmd.AddCommand(downloadCmd)
 
 	downloadCmd.Flags().Bool("skip-tables", false, "skip tables that might be missing from schema")
+	downloadCmd.Flags().Bool("allow-incomplete", false, "restore snapshots that were not completely uploaded")
 	downloadCmd.Flags().StringP("node", "n", "", "the ip address of the destination node")
 	downloadCmd.Flags().StringP("snapshot-id", "s", "", "snapshot id")
-	downloadCmd.Flags().StringP("aws-region", "r", "", "the aws region to use")
-	downloadCmd.Flags().StringP("aws-s3-bucket", "b", "", "the aws s3 bucket to use")
+	downloadCmd.Flags().Int("restore-days", 3, "days restored copies of archived objects stay available")
+	downloadCmd.Flags().String("restore-tier", "Standard", "retrieval tier for archived objects (Expedited, Standard, Bulk)")
+	downloadCmd.Flags().Duration("restore-poll", 5*time.Minute, "how often to check on archived objects being restored")
+	downloadCmd.Flags().String("point-in-time", "", "also restore archived commit logs and replay them up to this time (RFC3339)")
+	downloadCmd.Flags().String("commitlog-restore-dir", "/var/lib/cassandra/commitlog_restore", "directory archived commit logs are downloaded to")
+	addThrottleFlags(downloadCmd, 0)
+	addEncryptionFlags(downloadCmd)
+	addStorageFlags(downloadCmd)
 
 	downloadCmd.MarkFlagRequired("node")
 	downloadCmd.MarkFlagRequired("snapshot-id")
-	downloadCmd.MarkFlagRequired("aws-region")
-	downloadCmd.MarkFlagRequired("aws-s3-bucket")
-
 }
 
 // downloadCmd represents the download command
@@ -35,12 +40,28 @@ var downloadCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		var (
 			node, _       = cmd.Flags().GetString("node")
-			region, _     = cmd.Flags().GetString("aws-region")
-			bucket, _     = cmd.Flags().GetString("aws-s3-bucket")
 			snapshotID, _ = cmd.Flags().GetString("snapshot-id")
 			skipTables, _ = cmd.Flags().GetBool("skip-tables")
-			config        = &snappy.AWSConfig{Bucket: bucket, Region: region}
+			days, _       = cmd.Flags().GetInt("restore-days")
+			tier, _       = cmd.Flags().GetString("restore-tier")
+			poll, _       = cmd.Flags().GetDuration("restore-poll")
+			incomplete, _ = cmd.Flags().GetBool("allow-incomplete")
+			pitr, _       = cmd.Flags().GetString("point-in-time")
+			restoreDir, _ = cmd.Flags().GetString("commitlog-restore-dir")
 		)
+		config, err := storageConfig(cmd)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := applyThrottle(cmd); err != nil {
+			log.Fatal(err)
+		}
+		var pointInTime time.Time
+		if pitr != "" {
+			if pointInTime, err = time.Parse(time.RFC3339, pitr); err != nil {
+				log.Fatalf("invalid --point-in-time: %v", err)
+			}
+		}
 		mappingFile, err := ioutil.ReadFile(args[0])
 		if err != nil {
 			log.Fatal(err)
@@ -48,6 +69,21 @@ var downloadCmd = &cobra.Command{
 		prepareMapping := &snappy.PrepareMapping{}
 		json.Unmarshal(mappingFile, &prepareMapping)
 
-		snappy.DownloadSnapshot(node, snapshotID, config, prepareMapping, skipTables)
+		keyring, err := loadKeyring(cmd)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		options := &snappy.DownloadOptions{
+			SkipTables:          skipTables,
+			RestoreDays:         days,
+			RestoreTier:         tier,
+			RestorePollInterval: poll,
+			AllowIncomplete:     incomplete,
+			PointInTime:         pointInTime,
+			CommitlogDirectory:  restoreDir,
+			Keyring:             keyring,
+		}
+		snappy.DownloadSnapshot(node, snapshotID, config, prepareMapping, options)
 	},
 }
@@ -0,0 +1,43 @@
+// Copyright © 2018 ThreeComma.io <hello@threecomma.io>
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/threecommaio/snappy/pkg/snappy"
+)
+
+// addEncryptionFlags registers the flags selecting the master keys of encrypted backups
+func addEncryptionFlags(cmd *cobra.Command) {
+	cmd.Flags().String("kms-key-id", "", "encrypt with a data key per file wrapped by this aws kms key (id, arn or alias)")
+	cmd.Flags().StringSlice("encryption-key", nil, "file with a 256 bit master key, the first one encrypts new files, repeat to decrypt files written with older keys")
+}
+
+// loadKeyring builds a keyring from the flags registered by addEncryptionFlags, it returns nil when no key was given
+func loadKeyring(cmd *cobra.Command) (*snappy.Keyring, error) {
+	var (
+		kmsKeyID, _ = cmd.Flags().GetString("kms-key-id")
+		files, _    = cmd.Flags().GetStringSlice("encryption-key")
+		keys        []snappy.MasterKey
+	)
+
+	if kmsKeyID != "" {
+		key, err := snappy.NewKMSKey(kmsKeyID)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	for _, file := range files {
+		key, err := snappy.LoadKeyFile(file)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	return snappy.NewKeyring(keys...)
+}
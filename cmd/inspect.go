@@ -0,0 +1,108 @@
+// Copyright © 2018 ThreeComma.io <hello@threecomma.io>
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	humanize "github.com/dustin/go-humanize"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/threecommaio/snappy/pkg/snappy"
+)
+
+// inspectCmd represents the inspect command
+var inspectCmd = &cobra.Command{
+	Use:   "inspect [snapshot-id]",
+	Short: "Shows the nodes, keyspaces, tables and SSTables of a snapshot",
+	Long: `Shows what a snapshot contains on every node: file counts, sizes and SSTable counts per
+keyspace and table, table UUIDs and the token ranges of every node. Nodes that did not
+complete the snapshot and SSTables missing components are flagged.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			snapshotID = args[0]
+			output, _  = cmd.Flags().GetString("output")
+			tokens, _  = cmd.Flags().GetBool("tokens")
+		)
+		if output != "table" && output != "json" {
+			log.Fatalf("unknown --output [%s], expected table or json", output)
+		}
+		config, err := storageConfig(cmd)
+		if err != nil {
+			log.Fatal(err)
+		}
+		keyring, err := loadKeyring(cmd)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		report, err := snappy.Inspect(config, snapshotID, keyring)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if output == "json" {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "\t")
+			if err := enc.Encode(report); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		printReport(report, tokens)
+	},
+}
+
+// printReport prints the nodes of a snapshot, each with a table per line
+func printReport(report *snappy.SnapshotReport, tokens bool) {
+	fmt.Printf("Snapshot: %s\n", report.SnapshotID)
+	if report.Base != "" {
+		fmt.Printf("Base:     %s\n", report.Base)
+	}
+	fmt.Printf("Cluster:  %s\n", orDash(report.Cluster))
+	fmt.Printf("Complete: %t\n", report.Complete)
+
+	for _, node := range report.Nodes {
+		fmt.Printf("\nNode %s  dc %s  rack %s  host %s  cassandra %s  snappy %s\n", node.Address, orDash(node.Datacenter),
+			orDash(node.Rack), orDash(node.HostID), orDash(node.CassandraVersion), orDash(node.SnappyVersion))
+		if !node.Complete {
+			fmt.Println("  WARNING: node did not write its completion marker, the snapshot of this node is incomplete")
+		}
+		fmt.Printf("  %d files, %s, %d sstables, %d token ranges\n", node.Files, humanize.Bytes(uint64(node.Size)), node.SSTables, len(node.TokenRanges))
+		if tokens {
+			for _, r := range node.TokenRanges {
+				fmt.Printf("  (%s, %s]\n", r.Start, r.End)
+			}
+		}
+
+		var warnings []string
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "  KEYSPACE\tTABLE\tUUID\tFILES\tSIZE\tSSTABLES")
+		for _, ks := range node.Keyspaces {
+			for _, t := range ks.Tables {
+				fmt.Fprintf(w, "  %s\t%s\t%s\t%d\t%s\t%d\n", ks.Name, t.Name, t.UUID, t.Files, humanize.Bytes(uint64(t.Size)), t.SSTables)
+				for _, sstable := range t.Incomplete {
+					warnings = append(warnings, fmt.Sprintf("  WARNING: %s.%s sstable %s is missing %s",
+						ks.Name, t.Name, sstable.Name, strings.Join(sstable.Missing, ", ")))
+				}
+			}
+		}
+		w.Flush()
+		for _, warning := range warnings {
+			fmt.Println(warning)
+		}
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(inspectCmd)
+
+	inspectCmd.Flags().StringP("output", "o", "table", "output format, table or json")
+	inspectCmd.Flags().Bool("tokens", false, "print the token ranges of every node")
+	addEncryptionFlags(inspectCmd)
+	addStorageFlags(inspectCmd)
+}
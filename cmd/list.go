@@ -0,0 +1,126 @@
+// Copyright © 2018 ThreeComma.io <hello@threecomma.io>
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/threecommaio/snappy/pkg/snappy"
+)
+
+// listCmd represents the list command
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists the snapshots on a backup destination",
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			since, _     = cmd.Flags().GetString("since")
+			until, _     = cmd.Flags().GetString("until")
+			nodes, _     = cmd.Flags().GetStringSlice("nodes")
+			keyspaces, _ = cmd.Flags().GetStringSlice("keyspaces")
+			output, _    = cmd.Flags().GetString("output")
+		)
+		if output != "table" && output != "json" {
+			log.Fatalf("unknown --output [%s], expected table or json", output)
+		}
+		config, err := storageConfig(cmd)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		options := &snappy.ListOptions{Nodes: nodes, Keyspaces: keyspaces}
+		if options.Since, err = parseTime(since, false); err != nil {
+			log.Fatal(err)
+		}
+		if options.Until, err = parseTime(until, true); err != nil {
+			log.Fatal(err)
+		}
+
+		summaries, err := snappy.ListBackups(config, options)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if output == "json" {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "\t")
+			if err := enc.Encode(summaries); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		printSummaries(summaries)
+	},
+}
+
+// parseTime reads a date or an RFC 3339 time, a date used as the end of a range includes the whole day
+func parseTime(value string, end bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return t, fmt.Errorf("invalid time [%s], expected a date (2006-01-02) or an RFC 3339 time", value)
+	}
+	if end {
+		t = t.Add(24*time.Hour - time.Nanosecond)
+	}
+	return t, nil
+}
+
+// printSummaries prints a snapshot per line
+func printSummaries(summaries []snappy.SnapshotSummary) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SNAPSHOT\tBASE\tNODES\tCOMPLETE\tFILES\tSIZE\tSTARTED\tFINISHED\tLABELS")
+	for _, s := range summaries {
+		nodes := fmt.Sprint(len(s.Nodes))
+		if len(s.IncompleteNodes) > 0 {
+			nodes = fmt.Sprintf("%d/%d", len(s.Nodes)-len(s.IncompleteNodes), len(s.Nodes))
+		}
+		var labels []string
+		for k, v := range s.Labels {
+			labels = append(labels, k+"="+v)
+		}
+		sort.Strings(labels)
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%d\t%s\t%s\t%s\t%s\n", s.SnapshotID, orDash(s.Base), nodes, s.Complete,
+			s.Files, humanize.Bytes(uint64(s.Size)), formatTime(s.StartedAt), formatTime(s.FinishedAt), orDash(strings.Join(labels, ",")))
+	}
+	w.Flush()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func init() {
+	rootCmd.AddCommand(listCmd)
+
+	listCmd.Flags().String("since", "", "only list snapshots started at or after this date or time")
+	listCmd.Flags().String("until", "", "only list snapshots started at or before this date or time")
+	listCmd.Flags().StringSliceP("nodes", "n", []string{}, "only list snapshots of these nodes, and count only their files")
+	listCmd.Flags().StringSliceP("keyspaces", "k", []string{}, "only list snapshots of these keyspaces, and count only their files")
+	listCmd.Flags().StringP("output", "o", "table", "output format, table or json")
+	addStorageFlags(listCmd)
+}
@@ -0,0 +1,96 @@
+// Copyright © 2018 ThreeComma.io <hello@threecomma.io>
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/threecommaio/snappy/pkg/snappy"
+)
+
+// pruneCmd represents the prune command
+var pruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Deletes old snapshots from a destination following a retention policy",
+	Long: `Deletes the snapshots a retention policy does not keep. A snapshot is kept when any
+rule keeps it, e.g. --keep-daily 7 --keep-weekly 4 --keep-monthly 12 keeps the newest
+snapshot of each of the last 7 days, 4 weeks and 12 months. --max-age deletes older
+snapshots even when a rule keeps them.
+
+The newest complete snapshot, snapshots that may still be uploading and the base
+snapshots of kept incremental backups are never deleted. Shared objects are deleted
+once no snapshot references them any more and they are older than --shared-grace.
+Do not run prune while a backup with --dedup writes to the same destination.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			keepLast, _    = cmd.Flags().GetInt("keep-last")
+			keepDaily, _   = cmd.Flags().GetInt("keep-daily")
+			keepWeekly, _  = cmd.Flags().GetInt("keep-weekly")
+			keepMonthly, _ = cmd.Flags().GetInt("keep-monthly")
+			maxAge, _      = cmd.Flags().GetDuration("max-age")
+			cluster, _     = cmd.Flags().GetString("cluster")
+			keyspaces, _   = cmd.Flags().GetStringSlice("keyspaces")
+			sharedGrace, _ = cmd.Flags().GetDuration("shared-grace")
+			dryRun, _      = cmd.Flags().GetBool("dry-run")
+		)
+		config, err := storageConfig(cmd)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		options := &snappy.PruneOptions{
+			Policy: snappy.RetentionPolicy{
+				KeepLast:    keepLast,
+				KeepDaily:   keepDaily,
+				KeepWeekly:  keepWeekly,
+				KeepMonthly: keepMonthly,
+				MaxAge:      maxAge,
+			},
+			Cluster:     cluster,
+			Keyspaces:   keyspaces,
+			SharedGrace: sharedGrace,
+			DryRun:      dryRun,
+		}
+		decisions, err := snappy.Prune(config, options)
+		if len(decisions) > 0 {
+			printPruneDecisions(decisions)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+// printPruneDecisions prints what prune did with every snapshot
+func printPruneDecisions(decisions []snappy.PruneDecision) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SNAPSHOT\tCREATED\tCOMPLETE\tACTION\tREASON")
+	for _, d := range decisions {
+		action := "delete"
+		if d.Keep {
+			action = "keep"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%t\t%s\t%s\n", d.SnapshotID, formatTime(d.CreatedAt), d.Complete, action, d.Reason)
+	}
+	w.Flush()
+}
+
+func init() {
+	rootCmd.AddCommand(pruneCmd)
+
+	pruneCmd.Flags().Int("keep-last", 0, "keep the last N complete snapshots")
+	pruneCmd.Flags().Int("keep-daily", 0, "keep the newest snapshot of each of the last N days")
+	pruneCmd.Flags().Int("keep-weekly", 0, "keep the newest snapshot of each of the last N weeks")
+	pruneCmd.Flags().Int("keep-monthly", 0, "keep the newest snapshot of each of the last N months")
+	pruneCmd.Flags().Duration("max-age", 0, "delete snapshots older than this, e.g. 2160h for 90 days")
+	pruneCmd.Flags().String("cluster", "", "only prune the snapshots of this cluster")
+	pruneCmd.Flags().StringSliceP("keyspaces", "k", []string{}, "only delete the files of these keyspaces, the snapshots are kept")
+	pruneCmd.Flags().Duration("shared-grace", 24*time.Hour, "keep unreferenced shared objects modified within this window")
+	pruneCmd.Flags().Bool("dry-run", false, "list what would be deleted without deleting anything")
+	addStorageFlags(pruneCmd)
+}
@@ -9,7 +9,7 @@ import (
 // restoreCmd represents the restore command
 var restoreCmd = &cobra.Command{
 	Use:   "restore",
-	Short: "Restores a snapshot from S3",
+	Short: "Restores a snapshot from a backup destination",
 }
 
 func init() {
@@ -30,6 +30,7 @@ var rootCmd = &cobra.Command{
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute(version string) {
 	VERSION = version
+	snappy.Version = version
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
@@ -68,7 +69,7 @@ func initConfig() {
 
 	debug, _ := rootCmd.Flags().GetBool("debug")
 
-	log.SetFormatter(snappy.UTCFormatter{&log.TextFormatter{FullTimestamp: true}})
+	log.SetFormatter(snappy.UTCFormatter{Formatter: &log.TextFormatter{FullTimestamp: true}})
 
 	if debug {
 		log.SetLevel(log.DebugLevel)
@@ -0,0 +1,80 @@
+// Copyright © 2018 ThreeComma.io <hello@threecomma.io>
+
+package cmd
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/threecommaio/snappy/pkg/snappy"
+)
+
+func init() {
+	restoreCmd.AddCommand(schemaCmd)
+
+	schemaCmd.Flags().StringP("snapshot-id", "s", "", "snapshot id")
+	schemaCmd.Flags().StringP("node", "n", "", "the ip address of the source node whose schema is used (default: first node in the snapshot)")
+	schemaCmd.Flags().Bool("apply", false, "apply the schema to the local node with cqlsh instead of printing it")
+	schemaCmd.Flags().String("replication", "", "replace the replication of every keyspace, e.g. \"{'class': 'NetworkTopologyStrategy', 'dc1': 3}\"")
+	schemaCmd.Flags().StringSlice("rename-dc", nil, "rename a datacenter in the replication settings (old=new)")
+	addEncryptionFlags(schemaCmd)
+	addStorageFlags(schemaCmd)
+
+	schemaCmd.MarkFlagRequired("snapshot-id")
+}
+
+// schemaCmd represents the schema command
+var schemaCmd = &cobra.Command{
+	Use:   "schema",
+	Short: "Print or apply the schema of a snappy snapshot",
+	Long: `Print or apply the keyspaces and tables of a snapshot, this has to be done on
+the destination cluster before downloading the data.
+
+Every statement is made idempotent with IF NOT EXISTS, the replication of the
+keyspaces can be rewritten for a destination cluster with other datacenters.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			snapshotID, _  = cmd.Flags().GetString("snapshot-id")
+			node, _        = cmd.Flags().GetString("node")
+			apply, _       = cmd.Flags().GetBool("apply")
+			replication, _ = cmd.Flags().GetString("replication")
+			renames, _     = cmd.Flags().GetStringSlice("rename-dc")
+		)
+		config, err := storageConfig(cmd)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		keyring, err := loadKeyring(cmd)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		options := &snappy.SchemaOptions{
+			Replication:       replication,
+			RenameDatacenters: make(map[string]string),
+			Keyring:           keyring,
+		}
+		for _, rename := range renames {
+			from, to := snappy.Split(rename, "=")
+			if from == "" || to == "" {
+				log.Fatalf("invalid --rename-dc [%s], expected old=new", rename)
+			}
+			options.RenameDatacenters[from] = to
+		}
+
+		schema, err := snappy.SnapshotSchema(config, snapshotID, node, options)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !apply {
+			fmt.Print(schema)
+			return
+		}
+		if err := snappy.ApplySchema(schema); err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("applied the schema of snapshot [%s]", snapshotID)
+	},
+}
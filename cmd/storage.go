@@ -0,0 +1,109 @@
+// Copyright © 2018 ThreeComma.io <hello@threecomma.io>
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/threecommaio/snappy/pkg/snappy"
+)
+
+// addStorageFlags registers the flags used to select a backup destination
+func addStorageFlags(cmd *cobra.Command) {
+	cmd.Flags().StringSliceP("destination", "u", []string{}, "the backup destination url (e.g. s3://bucket/prefix, gs://bucket/prefix, az://account/container/prefix, sftp://user@host/path, file:///mnt/backups)")
+	cmd.Flags().StringP("aws-region", "r", "", "the aws region to use, detected from the bucket when empty")
+	cmd.Flags().StringP("aws-s3-bucket", "b", "", "the aws s3 bucket to use, shorthand for --destination s3://bucket")
+	cmd.Flags().String("s3-endpoint", "", "endpoint url of an s3 compatible server (e.g. https://minio.local:9000)")
+	cmd.Flags().Bool("s3-path-style", false, "use path style addressing (endpoint/bucket) instead of virtual hosted buckets")
+	cmd.Flags().String("s3-ca-bundle", "", "pem file with certificate authorities to trust for the s3 endpoint")
+	cmd.Flags().Bool("s3-insecure-tls", false, "skip tls certificate verification of the s3 endpoint")
+	cmd.Flags().String("gcs-credentials", "", "service account key file, defaults to application default credentials")
+	cmd.Flags().String("gcs-endpoint", "", "endpoint url of a gcs emulator (e.g. http://localhost:4443)")
+	cmd.Flags().String("azure-account-key", "", "azure storage account key, defaults to AZURE_STORAGE_KEY")
+	cmd.Flags().String("azure-sas-token", "", "azure shared access signature, defaults to AZURE_STORAGE_SAS_TOKEN")
+	cmd.Flags().Bool("azure-managed-identity", false, "authenticate to azure with the managed identity of this machine")
+	cmd.Flags().String("azure-client-id", "", "client id of a user assigned managed identity")
+	cmd.Flags().String("azure-endpoint", "", "blob service url of an azure emulator (e.g. http://127.0.0.1:10000/devstoreaccount1)")
+	cmd.Flags().String("sftp-key", "", "private key used to authenticate to the sftp host, defaults to the keys in ~/.ssh")
+	cmd.Flags().String("sftp-known-hosts", "", "known hosts file used to verify the sftp host, defaults to ~/.ssh/known_hosts")
+}
+
+// storageConfig builds a storage config from the flags registered by addStorageFlags
+func storageConfig(cmd *cobra.Command) (*snappy.StorageConfig, error) {
+	configs, err := storageConfigs(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if len(configs) > 1 {
+		return nil, fmt.Errorf("only a single --destination can be used with %s", cmd.Name())
+	}
+	return configs[0], nil
+}
+
+// storageConfigs builds a storage config for every destination given on the command line
+func storageConfigs(cmd *cobra.Command) ([]*snappy.StorageConfig, error) {
+	var (
+		destinations, _ = cmd.Flags().GetStringSlice("destination")
+		bucket, _       = cmd.Flags().GetString("aws-s3-bucket")
+		configs         []*snappy.StorageConfig
+	)
+
+	if bucket != "" {
+		destinations = append(destinations, fmt.Sprintf("s3://%s", bucket))
+	}
+	if len(destinations) == 0 {
+		return nil, fmt.Errorf("either --destination or --aws-s3-bucket must be set")
+	}
+
+	for _, destination := range destinations {
+		configs = append(configs, newStorageConfig(cmd, destination))
+	}
+	return configs, nil
+}
+
+// newStorageConfig builds a storage config for destination using the backend flags registered by addStorageFlags
+func newStorageConfig(cmd *cobra.Command, destination string) *snappy.StorageConfig {
+	var (
+		region, _      = cmd.Flags().GetString("aws-region")
+		endpoint, _    = cmd.Flags().GetString("s3-endpoint")
+		pathStyle, _   = cmd.Flags().GetBool("s3-path-style")
+		caBundle, _    = cmd.Flags().GetString("s3-ca-bundle")
+		insecureTLS, _ = cmd.Flags().GetBool("s3-insecure-tls")
+		gcsCreds, _    = cmd.Flags().GetString("gcs-credentials")
+		gcsEndpoint, _ = cmd.Flags().GetString("gcs-endpoint")
+		azureKey, _    = cmd.Flags().GetString("azure-account-key")
+		azureSAS, _    = cmd.Flags().GetString("azure-sas-token")
+		azureMSI, _    = cmd.Flags().GetBool("azure-managed-identity")
+		azureClient, _ = cmd.Flags().GetString("azure-client-id")
+		azureURL, _    = cmd.Flags().GetString("azure-endpoint")
+		sftpKey, _     = cmd.Flags().GetString("sftp-key")
+		knownHosts, _  = cmd.Flags().GetString("sftp-known-hosts")
+	)
+
+	return &snappy.StorageConfig{
+		Destination: destination,
+		AWS: snappy.AWSConfig{
+			Region:      region,
+			Endpoint:    endpoint,
+			PathStyle:   pathStyle,
+			CABundle:    caBundle,
+			InsecureTLS: insecureTLS,
+		},
+		GCS: snappy.GCSConfig{
+			CredentialsFile: gcsCreds,
+			Endpoint:        gcsEndpoint,
+		},
+		Azure: snappy.AzureConfig{
+			AccountKey:              azureKey,
+			SASToken:                azureSAS,
+			ManagedIdentity:         azureMSI,
+			ManagedIdentityClientID: azureClient,
+			Endpoint:                azureURL,
+		},
+		SFTP: snappy.SFTPConfig{
+			KeyFile:        sftpKey,
+			KnownHostsFile: knownHosts,
+		},
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright © 2018 ThreeComma.io <hello@threecomma.io>
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/threecommaio/snappy/pkg/snappy"
+)
+
+// addThrottleFlags registers the flags limiting the bandwidth of every transfer in the process
+func addThrottleFlags(cmd *cobra.Command, throttle int) {
+	cmd.Flags().IntP("throttle", "t", throttle, "network limit in megabits/s shared by all transfers, 0 means unlimited")
+	cmd.Flags().Int("disk-throttle", 0, "disk read and write limit in megabits/s shared by all transfers, 0 means unlimited")
+	cmd.Flags().String("control-address", "", "serve an http endpoint to change the limits while running (e.g. 127.0.0.1:7070)")
+}
+
+// applyThrottle sets the process wide limits from the flags registered by addThrottleFlags
+func applyThrottle(cmd *cobra.Command) error {
+	var (
+		network, _ = cmd.Flags().GetInt("throttle")
+		disk, _    = cmd.Flags().GetInt("disk-throttle")
+		address, _ = cmd.Flags().GetString("control-address")
+	)
+	if network < 0 || disk < 0 {
+		return fmt.Errorf("--throttle and --disk-throttle cannot be negative")
+	}
+	snappy.SetLimits(snappy.Limits{Network: network, Disk: disk})
+
+	if address != "" {
+		return snappy.ServeLimits(address)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright © 2018 ThreeComma.io <hello@threecomma.io>
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/threecommaio/snappy/pkg/snappy"
+)
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify [snapshot-id]",
+	Short: "Checks every file of a snapshot is stored with the right size and checksum",
+	Long: `Checks every file in the manifests of a snapshot exists on the destination with the
+expected size and checksum, and that every node completed the snapshot.
+
+With --deep every object is downloaded and decoded, its sha256 is recomputed and the
+Data.db of every SSTable is checked against its Digest and CRC.db components.
+
+Exits non-zero when a problem is found, so it can run from monitoring.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			snapshotID  = args[0]
+			deep, _     = cmd.Flags().GetBool("deep")
+			parallel, _ = cmd.Flags().GetInt("parallel")
+			output, _   = cmd.Flags().GetString("output")
+		)
+		if output != "table" && output != "json" {
+			log.Fatalf("unknown --output [%s], expected table or json", output)
+		}
+		if parallel < 1 {
+			log.Fatal("--parallel must be at least 1")
+		}
+		config, err := storageConfig(cmd)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := applyThrottle(cmd); err != nil {
+			log.Fatal(err)
+		}
+
+		options := &snappy.VerifyOptions{Deep: deep, Parallel: parallel}
+		if options.Keyring, err = loadKeyring(cmd); err != nil {
+			log.Fatal(err)
+		}
+
+		report, err := snappy.Verify(config, snapshotID, options)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if output == "json" {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "\t")
+			if err := enc.Encode(report); err != nil {
+				log.Fatal(err)
+			}
+		} else if !report.OK() {
+			printVerifyReport(report)
+		}
+		if !report.OK() {
+			log.Fatalf("snapshot [%s] failed verification, %d objects have problems", snapshotID, len(report.Failed))
+		}
+	},
+}
+
+// printVerifyReport prints a failed file per line with its problems
+func printVerifyReport(report *snappy.VerifyReport) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tKEY\tPROBLEMS")
+	for _, result := range report.Failed {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", result.Node, result.Key, strings.Join(result.Problems, "; "))
+	}
+	w.Flush()
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+
+	verifyCmd.Flags().Bool("deep", false, "download every object to recompute its checksum and the SSTable digests")
+	verifyCmd.Flags().IntP("parallel", "p", 4, "number of files verified at the same time")
+	verifyCmd.Flags().StringP("output", "o", "table", "output format, table or json")
+	addThrottleFlags(verifyCmd, 0)
+	addEncryptionFlags(verifyCmd)
+	addStorageFlags(verifyCmd)
+}
@@ -0,0 +1,621 @@
+package snappy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// 2021-12-02 is the first version that accepts the Cold access tier
+	azureAPIVersion = "2021-12-02"
+	// a blob is made of at most 50000 blocks, 32MB blocks allow objects up to 1.5TB
+	azureBlockSize         = 32 * 1024 * 1024
+	azureUploadConcurrency = 4
+	azureMaxAttempts       = 3
+	azureStorageResource   = "https://storage.azure.com/"
+	azureIMDSTokenURL      = "http://169.254.169.254/metadata/identity/oauth2/token"
+	azureMetadataPrefix    = "x-ms-meta-"
+	azureArchiveTier       = "Archive"
+)
+
+// Azure stores backups as block blobs in an Azure Blob Storage container
+type Azure struct {
+	account   string
+	container string
+	prefix    string
+	endpoint  string
+	key       []byte
+	sasToken  url.Values
+	identity  *azureIdentity
+	client    *http.Client
+}
+
+// AzureConfig holds the settings needed to reach Azure Blob Storage.
+// Exactly one of AccountKey, SASToken or ManagedIdentity is used, in that order.
+type AzureConfig struct {
+	Account   string
+	Container string
+	Prefix    string
+	// AccountKey is the base64 shared key of the storage account, defaults to AZURE_STORAGE_KEY
+	AccountKey string
+	// SASToken is a shared access signature query string, defaults to AZURE_STORAGE_SAS_TOKEN
+	SASToken string
+	// ManagedIdentity fetches tokens from the instance metadata service
+	ManagedIdentity bool
+	// ManagedIdentityClientID selects a user assigned identity
+	ManagedIdentityClientID string
+	// Endpoint overrides the blob service url, e.g. http://127.0.0.1:10000/devstoreaccount1 for Azurite
+	Endpoint string
+}
+
+// azureIdentity caches access tokens from the instance metadata service
+type azureIdentity struct {
+	clientID string
+	client   *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+type azureBlobList struct {
+	Blobs struct {
+		Blob []struct {
+			Name       azureBlobName `xml:"Name"`
+			Properties struct {
+				ContentLength int64  `xml:"Content-Length"`
+				LastModified  string `xml:"Last-Modified"`
+			} `xml:"Properties"`
+			Metadata struct {
+				Items []struct {
+					XMLName xml.Name
+					Value   string `xml:",chardata"`
+				} `xml:",any"`
+			} `xml:"Metadata"`
+		} `xml:"Blob"`
+		BlobPrefix []struct {
+			Name azureBlobName `xml:"Name"`
+		} `xml:"BlobPrefix"`
+	} `xml:"Blobs"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+// azureBlobName is a blob name in a listing, names with characters that are not valid in XML are percent encoded
+type azureBlobName struct {
+	Encoded bool   `xml:"Encoded,attr"`
+	Value   string `xml:",chardata"`
+}
+
+func (n azureBlobName) String() string {
+	if !n.Encoded {
+		return n.Value
+	}
+	if name, err := url.PathUnescape(n.Value); err == nil {
+		return name
+	}
+	return n.Value
+}
+
+func NewAzure(config *AzureConfig) (*Azure, error) {
+	a := &Azure{
+		account:   config.Account,
+		container: config.Container,
+		prefix:    config.Prefix,
+		endpoint:  strings.TrimSuffix(config.Endpoint, "/"),
+		client:    &http.Client{},
+	}
+	if a.endpoint == "" {
+		a.endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", a.account)
+	}
+
+	accountKey := config.AccountKey
+	if accountKey == "" {
+		accountKey = os.Getenv("AZURE_STORAGE_KEY")
+	}
+	sasToken := config.SASToken
+	if sasToken == "" {
+		sasToken = os.Getenv("AZURE_STORAGE_SAS_TOKEN")
+	}
+
+	switch {
+	case accountKey != "":
+		key, err := base64.StdEncoding.DecodeString(accountKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "azure account key is not valid base64")
+		}
+		a.key = key
+	case sasToken != "":
+		values, err := url.ParseQuery(strings.TrimPrefix(sasToken, "?"))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid azure sas token")
+		}
+		a.sasToken = values
+	case config.ManagedIdentity:
+		a.identity = &azureIdentity{clientID: config.ManagedIdentityClientID, client: &http.Client{Timeout: 30 * time.Second}}
+	default:
+		return nil, errors.New("azure requires an account key, a sas token or a managed identity")
+	}
+
+	resp, err := a.do(http.MethodGet, "", url.Values{"restype": {"container"}}, nil, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to reach container [%s]", a.container)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Info(azureError(resp))
+		return nil, errors.Errorf("container [%s] not found or you do not have sufficient permissions", a.container)
+	}
+
+	return a, nil
+}
+
+// Put uploads small objects with a single request and larger objects as
+// blocks sent in parallel, committed with a block list once all succeeded
+func (a *Azure) Put(key string, body io.Reader, opts PutOptions) error {
+	var (
+		buffers  = make(chan []byte, azureUploadConcurrency)
+		blockIDs []string
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	for i := 0; i < azureUploadConcurrency; i++ {
+		buffers <- make([]byte, azureBlockSize)
+	}
+
+	failed := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr
+	}
+
+	for i := 0; ; i++ {
+		buf := <-buffers
+		n, err := io.ReadFull(body, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			wg.Wait()
+			return err
+		}
+
+		if i == 0 && n < len(buf) {
+			return a.putBlob(key, buf[:n], opts)
+		}
+		if n == 0 {
+			break
+		}
+
+		id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%010d", i)))
+		blockIDs = append(blockIDs, id)
+
+		wg.Add(1)
+		go func(id string, buf []byte, n int) {
+			defer wg.Done()
+			if err := a.putBlock(key, id, buf[:n]); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+			buffers <- buf
+		}(id, buf, n)
+
+		if n < len(buf) || failed() != nil {
+			break
+		}
+	}
+	wg.Wait()
+
+	if err := failed(); err != nil {
+		return errors.Wrapf(err, "error uploading %s", key)
+	}
+	return a.putBlockList(key, blockIDs, opts)
+}
+
+func (a *Azure) putBlob(key string, data []byte, opts PutOptions) error {
+	headers := azurePutHeaders(opts)
+	headers.Set("X-Ms-Blob-Type", "BlockBlob")
+	return a.retry(func() (*http.Response, error) {
+		return a.do(http.MethodPut, key, nil, headers, data)
+	}, http.StatusCreated)
+}
+
+func (a *Azure) putBlock(key string, id string, data []byte) error {
+	params := url.Values{"comp": {"block"}, "blockid": {id}}
+	return a.retry(func() (*http.Response, error) {
+		return a.do(http.MethodPut, key, params, nil, data)
+	}, http.StatusCreated)
+}
+
+func (a *Azure) putBlockList(key string, blockIDs []string, opts PutOptions) error {
+	var list bytes.Buffer
+	list.WriteString(xml.Header + "<BlockList>")
+	for _, id := range blockIDs {
+		list.WriteString("<Latest>" + id + "</Latest>")
+	}
+	list.WriteString("</BlockList>")
+
+	params := url.Values{"comp": {"blocklist"}}
+	headers := azurePutHeaders(opts)
+	headers.Set("Content-Type", "application/xml")
+	return a.retry(func() (*http.Response, error) {
+		return a.do(http.MethodPut, key, params, headers, list.Bytes())
+	}, http.StatusCreated)
+}
+
+// azurePutHeaders sets blob metadata as x-ms-meta-* headers and the storage class as the access tier
+func azurePutHeaders(opts PutOptions) http.Header {
+	headers := http.Header{}
+	for k, v := range opts.Metadata {
+		headers.Set(azureMetadataPrefix+k, v)
+	}
+	if opts.StorageClass != "" {
+		headers.Set("X-Ms-Access-Tier", opts.StorageClass)
+	}
+	return headers
+}
+
+// retry repeats an idempotent request on network and server errors
+func (a *Azure) retry(send func() (*http.Response, error), expected int) error {
+	var err error
+	for attempt := 1; attempt <= azureMaxAttempts; attempt++ {
+		var resp *http.Response
+		resp, err = send()
+		if err == nil {
+			if resp.StatusCode == expected {
+				resp.Body.Close()
+				return nil
+			}
+			err = azureError(resp)
+			resp.Body.Close()
+			if resp.StatusCode < 500 {
+				return err
+			}
+		}
+		log.Debugf("azure request failed, retrying: %v", err)
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+	return err
+}
+
+// Get downloads the blob
+func (a *Azure) Get(key string) (io.ReadCloser, error) {
+	resp, err := a.do(http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, azureError(resp)
+	}
+	return resp.Body, nil
+}
+
+// Head reads the blob properties and metadata
+func (a *Azure) Head(key string) (*ObjectInfo, error) {
+	resp, err := a.do(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, azureError(resp)
+	}
+
+	info := &ObjectInfo{Key: key}
+	info.Size, _ = strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	info.LastModified, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	for name := range resp.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, azureMetadataPrefix) {
+			if info.Metadata == nil {
+				info.Metadata = make(map[string]string)
+			}
+			info.Metadata[strings.TrimPrefix(lower, azureMetadataPrefix)] = resp.Header.Get(name)
+		}
+	}
+	return info, nil
+}
+
+// List pages through the blobs under prefix
+func (a *Azure) List(prefix string, delimiter string) (*Listing, error) {
+	var (
+		listing = &Listing{}
+		marker  string
+	)
+
+	for {
+		params := url.Values{
+			"restype": {"container"},
+			"comp":    {"list"},
+			"prefix":  {joinKey(a.prefix, prefix)},
+			"include": {"metadata"},
+		}
+		if delimiter != "" {
+			params.Set("delimiter", delimiter)
+		}
+		if marker != "" {
+			params.Set("marker", marker)
+		}
+
+		page, err := a.listPage(params)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to list blobs")
+		}
+
+		for _, p := range page.Blobs.BlobPrefix {
+			listing.Prefixes = append(listing.Prefixes, trimKey(a.prefix, p.Name.String()))
+		}
+		for _, blob := range page.Blobs.Blob {
+			modified, _ := http.ParseTime(blob.Properties.LastModified)
+			info := ObjectInfo{
+				Key:          trimKey(a.prefix, blob.Name.String()),
+				Size:         blob.Properties.ContentLength,
+				LastModified: modified,
+			}
+			for _, item := range blob.Metadata.Items {
+				if info.Metadata == nil {
+					info.Metadata = make(map[string]string)
+				}
+				info.Metadata[strings.ToLower(item.XMLName.Local)] = item.Value
+			}
+			listing.Objects = append(listing.Objects, info)
+		}
+
+		if page.NextMarker == "" {
+			return listing, nil
+		}
+		marker = page.NextMarker
+	}
+}
+
+func (a *Azure) listPage(params url.Values) (*azureBlobList, error) {
+	resp, err := a.do(http.MethodGet, "", params, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, azureError(resp)
+	}
+
+	var page azureBlobList
+	if err := xml.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// Restore rehydrates blobs in the Archive tier to the Cool tier and reports whether the blob can be downloaded now.
+// Rehydrated blobs stay in the Cool tier, so days is ignored. The Expedited tier rehydrates with high priority.
+func (a *Azure) Restore(key string, days int, tier string) (bool, error) {
+	resp, err := a.do(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, azureError(resp)
+	}
+
+	if resp.Header.Get("X-Ms-Access-Tier") != azureArchiveTier {
+		return true, nil
+	}
+	// x-ms-archive-status is rehydrate-pending-to-cool while the blob is rehydrated
+	if strings.HasPrefix(resp.Header.Get("X-Ms-Archive-Status"), "rehydrate-pending") {
+		return false, nil
+	}
+
+	priority := "Standard"
+	if tier == "Expedited" {
+		priority = "High"
+	}
+	log.Debugf("requesting rehydration of archived blob [%s] with %s priority", key, priority)
+	headers := http.Header{}
+	headers.Set("X-Ms-Access-Tier", "Cool")
+	headers.Set("X-Ms-Rehydrate-Priority", priority)
+	err = a.retry(func() (*http.Response, error) {
+		return a.do(http.MethodPut, key, url.Values{"comp": {"tier"}}, headers, nil)
+	}, http.StatusAccepted)
+	return false, err
+}
+
+// Delete removes the blob, deleting a missing blob is not an error
+func (a *Azure) Delete(key string) error {
+	resp, err := a.do(http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusAccepted || resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	return azureError(resp)
+}
+
+// do sends an authorized request for a blob, or for the container when key is empty
+func (a *Azure) do(method, key string, params url.Values, headers http.Header, body []byte) (*http.Response, error) {
+	path := "/" + url.PathEscape(a.container)
+	if key != "" {
+		for _, segment := range strings.Split(joinKey(a.prefix, key), "/") {
+			path += "/" + url.PathEscape(segment)
+		}
+	}
+
+	query := url.Values{}
+	for k, v := range params {
+		query[k] = v
+	}
+	for k, v := range a.sasToken {
+		query[k] = v
+	}
+
+	u, err := url.Parse(a.endpoint + path)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		req.Body = nil
+		req.ContentLength = 0
+	}
+	for k, v := range headers {
+		req.Header[k] = v
+	}
+	req.Header.Set("X-Ms-Date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("X-Ms-Version", azureAPIVersion)
+
+	switch {
+	case a.key != nil:
+		req.Header.Set("Authorization", "SharedKey "+a.account+":"+a.sign(req, params))
+	case a.identity != nil:
+		token, err := a.identity.Token()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return a.client.Do(req)
+}
+
+// sign computes the shared key signature of a request
+func (a *Azure) sign(req *http.Request, params url.Values) string {
+	var contentLength string
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	var msHeaders []string
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-ms-") {
+			msHeaders = append(msHeaders, lower)
+		}
+	}
+	sort.Strings(msHeaders)
+
+	var b strings.Builder
+	for _, part := range []string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, x-ms-date is used instead
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+	} {
+		b.WriteString(part + "\n")
+	}
+	for _, name := range msHeaders {
+		b.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+
+	b.WriteString("/" + a.account + req.URL.EscapedPath())
+	var names []string
+	for name := range params {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values := params[name]
+		sort.Strings(values)
+		b.WriteString("\n" + name + ":" + strings.Join(values, ","))
+	}
+
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(b.String()))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Token returns a cached access token for the storage resource, refreshing it shortly before it expires
+func (i *azureIdentity) Token() (string, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.token != "" && time.Now().Add(5*time.Minute).Before(i.expires) {
+		return i.token, nil
+	}
+
+	params := url.Values{"api-version": {"2018-02-01"}, "resource": {azureStorageResource}}
+	if i.clientID != "" {
+		params.Set("client_id", i.clientID)
+	}
+	req, err := http.NewRequest(http.MethodGet, azureIMDSTokenURL+"?"+params.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata", "true")
+
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to reach the azure instance metadata service")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("managed identity token request failed: %s", resp.Status)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresOn   string `json:"expires_on"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	expires, _ := strconv.ParseInt(token.ExpiresOn, 10, 64)
+
+	i.token = token.AccessToken
+	i.expires = time.Unix(expires, 0)
+	return i.token, nil
+}
+
+// azureError turns an unexpected response into an error, mapping 404 to ErrNotExist
+func azureError(resp *http.Response) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotExist
+	}
+
+	var body struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err := xml.Unmarshal(data, &body); err == nil && body.Code != "" {
+		return errors.Errorf("azure: %s: %s", resp.Status, body.Code)
+	}
+	if code := resp.Header.Get("X-Ms-Error-Code"); code != "" {
+		return errors.Errorf("azure: %s: %s", resp.Status, code)
+	}
+	return errors.Errorf("azure: %s", resp.Status)
+}
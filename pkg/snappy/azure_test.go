@@ -0,0 +1,93 @@
+package snappy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// azureTierVersions is the first api version that accepts each access tier
+var azureTierVersions = map[string]string{
+	"Hot":     "2017-04-17",
+	"Cool":    "2017-04-17",
+	"Archive": "2017-04-17",
+	"Cold":    "2021-12-02",
+}
+
+func TestAzureAccessTierVersion(t *testing.T) {
+	for _, tier := range storageClasses["az"] {
+		version, ok := azureTierVersions[tier]
+		if !ok {
+			t.Errorf("access tier %s has no known minimum api version", tier)
+			continue
+		}
+		// api versions are dates, they compare as strings
+		if azureAPIVersion < version {
+			t.Errorf("access tier %s needs api version %s, requests use %s", tier, version, azureAPIVersion)
+		}
+	}
+}
+
+func testAzure(t *testing.T, handler http.HandlerFunc) *Azure {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	a, err := NewAzure(&AzureConfig{Account: "account", Container: "container", SASToken: "sv=test", Endpoint: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestAzurePutAccessTier(t *testing.T) {
+	var headers http.Header
+	a := testAzure(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			// NewAzure checks the container exists
+			return
+		}
+		headers = r.Header
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	if err := a.Put("backups/s1/n1/file", bytes.NewReader([]byte("data")), PutOptions{StorageClass: "Cold"}); err != nil {
+		t.Fatal(err)
+	}
+	if tier := headers.Get("X-Ms-Access-Tier"); tier != "Cold" {
+		t.Errorf("access tier is %q, expected Cold", tier)
+	}
+	if version := headers.Get("X-Ms-Version"); version < azureTierVersions["Cold"] {
+		t.Errorf("api version is %s, the Cold tier needs %s", version, azureTierVersions["Cold"])
+	}
+}
+
+func TestAzureListEncodedNames(t *testing.T) {
+	a := testAzure(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<?xml version="1.0" encoding="utf-8"?>
+<EnumerationResults>
+  <Blobs>
+    <Blob><Name>backups/s1/n1/plain</Name><Properties><Content-Length>4</Content-Length></Properties></Blob>
+    <Blob><Name Encoded="true">backups/s1/n1/tab%09name</Name><Properties><Content-Length>5</Content-Length></Properties></Blob>
+    <BlobPrefix><Name Encoded="true">backups/s%012/</Name></BlobPrefix>
+  </Blobs>
+  <NextMarker/>
+</EnumerationResults>`))
+	})
+
+	listing, err := a.List("backups/", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listing.Objects) != 2 {
+		t.Fatalf("listed %d objects, expected 2", len(listing.Objects))
+	}
+	if key := listing.Objects[0].Key; key != "backups/s1/n1/plain" {
+		t.Errorf("key is %q, expected backups/s1/n1/plain", key)
+	}
+	if key := listing.Objects[1].Key; key != "backups/s1/n1/tab\tname" {
+		t.Errorf("key is %q, expected the decoded name", key)
+	}
+	if len(listing.Prefixes) != 1 || listing.Prefixes[0] != "backups/s\x012/" {
+		t.Errorf("prefixes are %q, expected the decoded prefix", listing.Prefixes)
+	}
+}
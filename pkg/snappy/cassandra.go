@@ -65,6 +65,17 @@ func nodeTool() string {
 	return find("nodetool")
 }
 
+// cqlsh locates cqlsh in the usual install locations or the PATH
+func cqlsh() (string, error) {
+	for _, p := range searchPaths {
+		var pathFilename = filepath.Join(p, "cqlsh")
+		if _, err := os.Stat(pathFilename); err == nil {
+			return pathFilename, nil
+		}
+	}
+	return exec.LookPath("cqlsh")
+}
+
 func cassandraYaml() string {
 	return find("cassandra.yaml")
 }
@@ -102,6 +113,39 @@ func (c *Cassandra) CreateSnapshot(id string, keyspaces []string) (bool, error)
 	return true, nil
 }
 
+// ClearSnapshot removes a snapshot by ID from every keyspace
+func (c *Cassandra) ClearSnapshot(id string) error {
+	log.Infof("clearing local snapshot [%s]", id)
+	output, err := exec.Command(nodeTool(), "clearsnapshot", "-t", id).CombinedOutput()
+	if err != nil {
+		return errors.Errorf("nodetool clearsnapshot failed: %v %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// GetSnapshots returns the id of every snapshot found in the data directories, with the time it was last written to
+func (c *Cassandra) GetSnapshots(dataDirs []string) (map[string]time.Time, error) {
+	var snapshots = make(map[string]time.Time)
+
+	for _, dataDir := range dataDirs {
+		dirs, err := filepath.Glob(filepath.Join(dataDir, "*", "*", "snapshots", "*"))
+		if err != nil {
+			return nil, err
+		}
+		for _, dir := range dirs {
+			info, err := os.Stat(dir)
+			if err != nil || !info.IsDir() {
+				continue
+			}
+			id := filepath.Base(dir)
+			if info.ModTime().After(snapshots[id]) {
+				snapshots[id] = info.ModTime()
+			}
+		}
+	}
+	return snapshots, nil
+}
+
 // GetDataDirectories returns a list of data directories defined in the config
 func (c *Cassandra) GetDataDirectories() []string {
 	var directories []string
@@ -113,11 +157,31 @@ func (c *Cassandra) GetDataDirectories() []string {
 	return directories
 }
 
+// GetSnapshotFiles maps the files of a snapshot to their keys on the backup destination
 func (c *Cassandra) GetSnapshotFiles(id, nodeIP, prefix string, dataDirs []string) (map[string]string, error) {
-	var keyspaces []string
+	return c.getTableFiles(filepath.Join("snapshots", id), id, nodeIP, prefix, dataDirs)
+}
+
+// GetIncrementalFiles maps the sstables Cassandra hardlinked into the backups directory
+// of every table to their keys on the backup destination for incremental backup id
+func (c *Cassandra) GetIncrementalFiles(id, nodeIP, prefix string, dataDirs []string) (map[string]string, error) {
+	return c.getTableFiles("backups", id, nodeIP, prefix, dataDirs)
+}
+
+// IncrementalBackupsEnabled returns incremental_backups from the config
+func (c *Cassandra) IncrementalBackupsEnabled() bool {
+	enabled, _ := c.config["incremental_backups"].(bool)
+	return enabled
+}
+
+// getTableFiles walks subdir of every table directory and maps the files found to
+// <prefix>/<id>/<node>/<keyspace>/<table>/<file>
+func (c *Cassandra) getTableFiles(subdir, id, nodeIP, prefix string, dataDirs []string) (map[string]string, error) {
 	var snapshotFiles = make(map[string]string)
 
 	for _, dataDir := range dataDirs {
+		var keyspaces []string
+
 		files, err := ioutil.ReadDir(dataDir)
 		if err != nil {
 			return nil, err
@@ -146,7 +210,7 @@ func (c *Cassandra) GetSnapshotFiles(id, nodeIP, prefix string, dataDirs []strin
 
 			for _, table := range tables {
 				// check if keyspace, table, snapshot exist
-				tableDir := filepath.Join(dataDir, keyspace, table, "snapshots", id, "/")
+				tableDir := filepath.Join(dataDir, keyspace, table, subdir, "/")
 				if _, err := os.Stat(tableDir); os.IsNotExist(err) {
 					continue
 				}
@@ -185,6 +249,120 @@ func (c *Cassandra) GetListenAddress() string {
 	return localIP
 }
 
+// GetRPCAddress returns the address clients connect to, the rpc_address from the config or the listen address
+func (c *Cassandra) GetRPCAddress() string {
+	if val, ok := c.config["rpc_address"].(string); ok && val != "" && val != "0.0.0.0" {
+		return val
+	}
+	return c.GetListenAddress()
+}
+
+// DescribeSchema returns the CQL for every non system keyspace, as printed by cqlsh
+func (c *Cassandra) DescribeSchema() (string, error) {
+	output, err := c.CQL("-e", "DESCRIBE SCHEMA")
+	if err != nil {
+		return "", err
+	}
+	return output, nil
+}
+
+// CQL runs cqlsh against the local node with the given arguments, credentials are taken from ~/.cassandra/cqlshrc
+func (c *Cassandra) CQL(args ...string) (string, error) {
+	cqlsh, err := cqlsh()
+	if err != nil {
+		return "", errors.Wrap(err, "cqlsh not found")
+	}
+
+	var stderr strings.Builder
+	cmd := exec.Command(cqlsh, append([]string{c.GetRPCAddress()}, args...)...)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", errors.Errorf("cqlsh failed: %v %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return string(output), nil
+}
+
+// GetClusterName returns the cluster_name from the config
+func (c *Cassandra) GetClusterName() string {
+	if val, ok := c.config["cluster_name"]; ok {
+		return val.(string)
+	}
+	return ""
+}
+
+// GetNodeInfo reads the identity and tokens of the local node from nodetool info
+func (c *Cassandra) GetNodeInfo() (*NodeInfo, error) {
+	output, err := exec.Command(nodeTool(), "info", "-T").Output()
+	if err != nil {
+		return nil, errors.Wrap(err, "nodetool info failed")
+	}
+
+	info := &NodeInfo{}
+	for _, line := range strings.Split(string(output), "\n") {
+		name, value := Split(line, ":")
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(name) {
+		case "ID":
+			info.HostID = value
+		case "Data Center":
+			info.Datacenter = value
+		case "Rack":
+			info.Rack = value
+		case "Token":
+			info.Tokens = append(info.Tokens, value)
+		}
+	}
+	return info, nil
+}
+
+// GetVersion returns the release version reported by nodetool version
+func (c *Cassandra) GetVersion() (string, error) {
+	output, err := exec.Command(nodeTool(), "version").Output()
+	if err != nil {
+		return "", errors.Wrap(err, "nodetool version failed")
+	}
+	_, version := Split(strings.TrimSpace(string(output)), ":")
+	return strings.TrimSpace(version), nil
+}
+
+// GetPartitioner returns the partitioner from the config
+func (c *Cassandra) GetPartitioner() string {
+	if val, ok := c.config["partitioner"]; ok {
+		return val.(string)
+	}
+	return ""
+}
+
+// GetRingMembers returns the host id of every node owning tokens in the cluster, in all datacenters.
+// Nodes are identified by host id because nodetool status shows the broadcast address,
+// which differs from the listen address node snapshots are stored under on some networks.
+func (c *Cassandra) GetRingMembers() ([]string, error) {
+	output, err := exec.Command(nodeTool(), "status").Output()
+	if err != nil {
+		return nil, errors.Wrap(err, "nodetool status failed")
+	}
+
+	var members []string
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || len(fields[0]) != 2 {
+			continue
+		}
+		// status is U(p) or D(own), state is N(ormal), L(eaving), J(oining) or M(oving),
+		// joining nodes do not own any data yet
+		status, state := fields[0][0], fields[0][1]
+		if (status == 'U' || status == 'D') && strings.ContainsRune("NLM", rune(state)) {
+			// the host id is followed by the rack
+			members = append(members, fields[len(fields)-2])
+		}
+	}
+	if len(members) == 0 {
+		return nil, errors.New("no ring members found in nodetool status")
+	}
+	return members, nil
+}
+
 // GetTokenRange finds the range of tokens for an ip address in cluster
 func (c *Cassandra) GetTokenRange(ip string) ([]string, error) {
 	nodeTool := exec.Command(nodeTool(), "ring")
@@ -0,0 +1,52 @@
+package snappy
+
+import (
+	"path/filepath"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// cleanupSnapshots clears local snapshots once a backup was uploaded to every destination. Snapshots
+// count as taken by snappy when the node completed them on every destination, other snapshots are left alone.
+// The snapshot just uploaded is cleared unless it is kept with KeepLocal or among the newest KeepLast.
+func cleanupSnapshots(cassandra *Cassandra, fanout *Fanout, nodeIP, snapshotID string, options *BackupOptions) {
+	if options.KeepLocal && options.KeepLast == 0 {
+		return
+	}
+	if options.KeepLast == 0 {
+		if err := cassandra.ClearSnapshot(snapshotID); err != nil {
+			log.Warnf("unable to clear local snapshot [%s]: %v", snapshotID, err)
+		}
+		return
+	}
+
+	snapshots, err := cassandra.GetSnapshots(cassandra.GetDataDirectories())
+	if err != nil {
+		log.Warnf("unable to list local snapshots: %v", err)
+		return
+	}
+
+	var ids []string
+	for id := range snapshots {
+		if id == snapshotID || fanout.IsSnapshotComplete(filepath.Join(SnapshotFolderPrefix, id, nodeIP)) {
+			ids = append(ids, id)
+		}
+	}
+	// newest first, the snapshot just uploaded always counts as the newest
+	sort.Slice(ids, func(i, j int) bool {
+		if ids[i] == snapshotID || ids[j] == snapshotID {
+			return ids[i] == snapshotID
+		}
+		return snapshots[ids[i]].After(snapshots[ids[j]])
+	})
+
+	if len(ids) <= options.KeepLast {
+		return
+	}
+	for _, id := range ids[options.KeepLast:] {
+		if err := cassandra.ClearSnapshot(id); err != nil {
+			log.Warnf("unable to clear local snapshot [%s]: %v", id, err)
+		}
+	}
+}
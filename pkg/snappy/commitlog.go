@@ -0,0 +1,159 @@
+package snappy
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// CommitlogFolderPrefix holds archived commit log segments, commitlogs/<node>/<segment>
+	CommitlogFolderPrefix = "commitlogs"
+	// CommitlogArchivingProperties configures archiving and replay of commit log segments in Cassandra
+	CommitlogArchivingProperties = "commitlog_archiving.properties"
+	// restorePointFormat is the format Cassandra expects for restore_point_in_time, always in GMT
+	restorePointFormat = "2006:01:02 15:04:05"
+)
+
+// ArchiveCommitlog uploads a commit log segment, it is meant to be used as the
+// archive_command in commitlog_archiving.properties:
+//
+//	archive_command=/usr/local/bin/snappy commitlog archive %path %name -u s3://bucket/prefix
+//
+// Segments are encrypted when a keyring is given.
+func ArchiveCommitlog(config *StorageConfig, filename, name string, keyring *Keyring) error {
+	remote, err := OpenRemote(config)
+	if err != nil {
+		return err
+	}
+	cassandra := NewCassandra()
+	nodeIP := cassandra.GetListenAddress()
+
+	metadata := map[string]string{
+		MetadataCluster: cassandra.GetClusterName(),
+		MetadataNode:    nodeIP,
+		MetadataVersion: Version,
+	}
+	encoding := Encoding{Keyring: keyring}
+	if keyring != nil {
+		metadata[MetadataKeyID] = keyring.KeyID()
+	}
+	key := path.Join(CommitlogFolderPrefix, nodeIP, name) + encoding.Extension()
+	if err := remote.UploadFile(filename, key, metadata, encoding); err != nil {
+		return err
+	}
+	log.Infof("archived commit log segment [%s] to [%s]", name, remote)
+	return nil
+}
+
+// ListCommitlogs returns the commit log segments archived by a node, oldest first
+func (r *Remote) ListCommitlogs(node string) ([]ObjectInfo, error) {
+	listing, err := r.storage.List(path.Join(CommitlogFolderPrefix, node)+"/", "")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list commit log segments")
+	}
+
+	segments := listing.Objects
+	sort.Slice(segments, func(i, j int) bool { return segments[i].LastModified.Before(segments[j].LastModified) })
+	return segments, nil
+}
+
+// selectCommitlogs returns the segments holding writes between a snapshot and the restore point.
+// A segment is archived once it is full, so the first segment archived after the restore point
+// still holds writes from before it. Cassandra skips mutations past restore_point_in_time on replay.
+func selectCommitlogs(segments []ObjectInfo, since, until time.Time) []ObjectInfo {
+	var selected []ObjectInfo
+	for _, segment := range segments {
+		if segment.LastModified.Before(since) {
+			continue
+		}
+		selected = append(selected, segment)
+		if segment.LastModified.After(until) {
+			break
+		}
+	}
+	return selected
+}
+
+// RestoreCommitlogs downloads the commit log segments archived by node after a snapshot was taken
+// and configures Cassandra to replay them up to pointInTime on its next start. The keyring is only
+// needed when segments were encrypted.
+func RestoreCommitlogs(remote *Remote, cassandra *Cassandra, node string, since, pointInTime time.Time, directory string, keyring *Keyring) error {
+	segments, err := remote.ListCommitlogs(node)
+	if err != nil {
+		return err
+	}
+	selected := selectCommitlogs(segments, since, pointInTime)
+	if len(selected) == 0 {
+		return errors.Errorf("no commit log segments were archived by node [%s] after the snapshot", node)
+	}
+	if last := selected[len(selected)-1]; last.LastModified.Before(pointInTime) {
+		log.Warnf("the last commit log segment was archived at %s, writes up to %s may be missing", last.LastModified.UTC(), pointInTime.UTC())
+	}
+
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return err
+	}
+	log.Infof("downloading %d commit log segments to %s", len(selected), directory)
+	for _, segment := range selected {
+		file := objectFile(segment)
+		if err := remote.downloadManifestFile(file, filepath.Join(directory, path.Base(file.Key)), keyring); err != nil {
+			return err
+		}
+	}
+
+	properties := filepath.Join(filepath.Dir(cassandra.GetConfigFilename()), CommitlogArchivingProperties)
+	err = updateProperties(properties, map[string]string{
+		"restore_command":       "cp -f %from %to",
+		"restore_directories":   directory,
+		"restore_point_in_time": pointInTime.UTC().Format(restorePointFormat),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "unable to update %s", properties)
+	}
+	log.Infof("configured %s to replay commit logs up to %s", properties, pointInTime.UTC())
+	return nil
+}
+
+// updateProperties sets values in a java properties file, keeping every other line as it is
+func updateProperties(filename string, values map[string]string) error {
+	var lines []string
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(data) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+
+	written := make(map[string]bool)
+	for i, line := range lines {
+		name, _ := Split(line, "=")
+		name = strings.TrimSpace(name)
+		if value, ok := values[name]; ok && !strings.HasPrefix(name, "#") {
+			lines[i] = name + "=" + value
+			written[name] = true
+		}
+	}
+
+	var names []string
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !written[name] {
+			lines = append(lines, name+"="+values[name])
+		}
+	}
+
+	return ioutil.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
@@ -0,0 +1,44 @@
+package snappy
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSelectCommitlogs(t *testing.T) {
+	start := time.Date(2018, 8, 1, 12, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time { return start.Add(time.Duration(minutes) * time.Minute) }
+
+	var segments []ObjectInfo
+	for i, minutes := range []int{-30, -10, 10, 20, 30, 40} {
+		segments = append(segments, ObjectInfo{
+			Key:          "commitlogs/10.0.0.1/CommitLog-6-" + string(rune('a'+i)) + ".log",
+			LastModified: at(minutes),
+		})
+	}
+
+	tests := []struct {
+		name         string
+		since, until time.Time
+		want         []int
+	}{
+		{"segments after the snapshot up to the first one past the restore point", at(0), at(25), []int{2, 3, 4}},
+		{"restore point matches an archive time", at(0), at(20), []int{2, 3, 4}},
+		{"restore point after the last segment", at(0), at(60), []int{2, 3, 4, 5}},
+		{"restore point before any segment after the snapshot", at(0), at(5), []int{2}},
+		{"snapshot taken after every segment", at(50), at(60), nil},
+		{"segment archived at the snapshot time", at(-10), at(15), []int{1, 2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var want []ObjectInfo
+			for _, idx := range tt.want {
+				want = append(want, segments[idx])
+			}
+			if got := selectCommitlogs(segments, tt.since, tt.until); !reflect.DeepEqual(got, want) {
+				t.Errorf("selected %v, expected %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package snappy
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/pkg/errors"
+)
+
+// Compression codecs files can be uploaded with
+const (
+	CodecZstd = "zstd"
+	CodecLZ4  = "lz4"
+)
+
+// codecExtensions are appended to the key of compressed objects, so they are recognised
+// when a manifest has to be rebuilt from a listing
+var codecExtensions = map[string]string{
+	CodecZstd: ".zst",
+	CodecLZ4:  ".lz4",
+}
+
+// Compression describes how a file is compressed while it is uploaded
+type Compression struct {
+	// Codec is zstd or lz4, files are uploaded as they are when empty
+	Codec string
+	// Level is the codec specific compression level, 0 uses the default of the codec
+	Level int
+}
+
+// Validate checks the codec and level are supported
+func (c Compression) Validate() error {
+	switch c.Codec {
+	case "":
+		return nil
+	case CodecZstd:
+		if c.Level < 0 || c.Level > 22 {
+			return errors.Errorf("zstd compression level must be between 0 (default) and 22, got %d", c.Level)
+		}
+	case CodecLZ4:
+		if c.Level < 0 || c.Level > 9 {
+			return errors.Errorf("lz4 compression level must be between 0 (default) and 9, got %d", c.Level)
+		}
+	default:
+		return errors.Errorf("unknown compression codec [%s], expected %s or %s", c.Codec, CodecZstd, CodecLZ4)
+	}
+	return nil
+}
+
+// Extension returns the suffix of the keys of objects compressed with the codec
+func (c Compression) Extension() string {
+	return codecExtensions[c.Codec]
+}
+
+// Reader compresses everything read from reader, the returned reader must be closed
+// to release the encoder when it is not read until the end
+func (c Compression) Reader(reader io.Reader) (io.ReadCloser, error) {
+	if c.Codec == "" {
+		return ioutil.NopCloser(reader), nil
+	}
+
+	pr, pw := io.Pipe()
+	encoder, err := c.writer(pw)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		_, err := io.Copy(encoder, reader)
+		if closeErr := encoder.Close(); err == nil {
+			err = closeErr
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+// writer returns an encoder writing compressed data to w
+func (c Compression) writer(w io.Writer) (io.WriteCloser, error) {
+	switch c.Codec {
+	case CodecZstd:
+		level := zstd.SpeedDefault
+		if c.Level > 0 {
+			level = zstd.EncoderLevelFromZstd(c.Level)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(1))
+	case CodecLZ4:
+		encoder := lz4.NewWriter(w)
+		level := lz4.Fast
+		if c.Level > 0 {
+			level = lz4.CompressionLevel(1 << (8 + c.Level))
+		}
+		if err := encoder.Apply(lz4.CompressionLevelOption(level)); err != nil {
+			return nil, err
+		}
+		return encoder, nil
+	default:
+		return nil, errors.Errorf("unknown compression codec [%s]", c.Codec)
+	}
+}
+
+// decompressReader returns a reader decompressing data compressed with codec
+func decompressReader(codec string, reader io.Reader) (io.ReadCloser, error) {
+	switch codec {
+	case "":
+		return ioutil.NopCloser(reader), nil
+	case CodecZstd:
+		decoder, err := zstd.NewReader(reader, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	case CodecLZ4:
+		return ioutil.NopCloser(lz4.NewReader(reader)), nil
+	default:
+		return nil, errors.Errorf("unknown compression codec [%s]", codec)
+	}
+}
+
+// codecFromKey returns the codec of an object from the extension of its key
+func codecFromKey(key string) string {
+	for codec, ext := range codecExtensions {
+		if strings.HasSuffix(key, ext) {
+			return codec
+		}
+	}
+	return ""
+}
+
+// cassandraCompressed reports whether Cassandra already compressed a file, the Data.db
+// component of an SSTable is compressed when it comes with a CompressionInfo.db
+func cassandraCompressed(filename string) bool {
+	if !strings.HasSuffix(filename, "-Data.db") {
+		return false
+	}
+	_, err := os.Stat(strings.TrimSuffix(filename, "Data.db") + "CompressionInfo.db")
+	return err == nil
+}
@@ -0,0 +1,100 @@
+package snappy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	compressible := bytes.Repeat([]byte("partition key, clustering key, cell value\n"), 32*1024)
+
+	tests := []struct {
+		name        string
+		compression Compression
+	}{
+		{"none", Compression{}},
+		{"zstd default", Compression{Codec: CodecZstd}},
+		{"zstd fastest", Compression{Codec: CodecZstd, Level: 1}},
+		{"zstd best", Compression{Codec: CodecZstd, Level: 22}},
+		{"lz4 default", Compression{Codec: CodecLZ4}},
+		{"lz4 best", Compression{Codec: CodecLZ4, Level: 9}},
+	}
+	inputs := map[string][]byte{
+		"empty":        {},
+		"small":        []byte("CREATE TABLE ks1.t1 (id int PRIMARY KEY);"),
+		"compressible": compressible,
+	}
+	for _, tt := range tests {
+		for input, data := range inputs {
+			t.Run(tt.name+" "+input, func(t *testing.T) {
+				if err := tt.compression.Validate(); err != nil {
+					t.Fatal(err)
+				}
+				reader, err := tt.compression.Reader(bytes.NewReader(data))
+				if err != nil {
+					t.Fatal(err)
+				}
+				compressed, err := ioutil.ReadAll(reader)
+				reader.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tt.compression.Codec != "" && len(data) == len(compressible) && len(compressed) >= len(data)/10 {
+					t.Errorf("compressed %d bytes to %d", len(data), len(compressed))
+				}
+
+				decoder, err := decompressReader(tt.compression.Codec, bytes.NewReader(compressed))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer decoder.Close()
+				decompressed, err := ioutil.ReadAll(decoder)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(decompressed, data) {
+					t.Fatalf("decompressed %d bytes do not match the %d bytes compressed", len(decompressed), len(data))
+				}
+			})
+		}
+	}
+}
+
+func TestCompressionValidate(t *testing.T) {
+	tests := []struct {
+		compression Compression
+		valid       bool
+	}{
+		{Compression{}, true},
+		{Compression{Codec: CodecZstd}, true},
+		{Compression{Codec: CodecZstd, Level: 22}, true},
+		{Compression{Codec: CodecZstd, Level: 23}, false},
+		{Compression{Codec: CodecZstd, Level: -1}, false},
+		{Compression{Codec: CodecLZ4, Level: 9}, true},
+		{Compression{Codec: CodecLZ4, Level: 10}, false},
+		{Compression{Codec: "gzip"}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.compression.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%s level %d: valid is %t, expected %t (%v)", tt.compression.Codec, tt.compression.Level, err == nil, tt.valid, err)
+		}
+	}
+}
+
+func TestCodecFromKey(t *testing.T) {
+	tests := []struct {
+		key   string
+		codec string
+	}{
+		{"backups/s1/10.0.0.1/ks1/t1-aaa/mc-1-big-Data.db", ""},
+		{"backups/s1/10.0.0.1/ks1/t1-aaa/mc-1-big-Data.db.zst", CodecZstd},
+		{"backups/s1/10.0.0.1/ks1/t1-aaa/mc-1-big-Data.db.lz4", CodecLZ4},
+		{"shared/ab/abcdef.zst.enc", ""},
+	}
+	for _, tt := range tests {
+		if codec := codecFromKey(tt.key); codec != tt.codec {
+			t.Errorf("%s: codec is %q, expected %q", tt.key, codec, tt.codec)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package snappy
+
+import (
+	"path"
+	"path/filepath"
+	"reflect"
+
+	"github.com/cheggaaa/pb"
+	humanize "github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// CopySnapshot replicates a snapshot from one destination to another for all nodes,
+// or only the given ones. Snapshots missing a completion marker are refused unless forced,
+// and the marker is written to the destination only after every file of a node was copied.
+// An incremental backup is only restorable with its base snapshot and the incremental backups
+// before it, those the destination does not hold yet are copied first.
+// The cluster marker follows once every node of a complete cluster snapshot is on the destination.
+func CopySnapshot(src *StorageConfig, dst *StorageConfig, snapshotID string, nodes []string, force bool) error {
+	from, err := OpenRemote(src)
+	if err != nil {
+		return errors.Wrapf(err, "source [%s]", src.Destination)
+	}
+	to, err := OpenRemote(dst)
+	if err != nil {
+		return errors.Wrapf(err, "destination [%s]", dst.Destination)
+	}
+
+	available := from.ListNodes(snapshotID)
+	if len(available) == 0 {
+		return errors.Errorf("snapshot [%s] not found on [%s]", snapshotID, from)
+	}
+	if len(nodes) == 0 {
+		nodes = available
+	}
+
+	for _, node := range nodes {
+		if !contains(available, node) {
+			return errors.Errorf("node [%s] not found in snapshot [%s]", node, snapshotID)
+		}
+		if err := checkComplete(from, snapshotID, node, force); err != nil {
+			return err
+		}
+	}
+
+	copied := []string{snapshotID}
+	for _, node := range nodes {
+		links, baseID, err := chainLinks(from, snapshotID, node)
+		if err != nil {
+			return err
+		}
+		for _, id := range links {
+			if to.IsSnapshotComplete(filepath.Join(SnapshotFolderPrefix, id, node)) {
+				continue
+			}
+			if err := checkComplete(from, id, node, force); err != nil {
+				return errors.Wrapf(err, "snapshot [%s] is an incremental backup of [%s]", snapshotID, baseID)
+			}
+			log.Infof("snapshot [%s] builds on snapshot [%s] for node [%s], copying it first", snapshotID, id, node)
+			if err := copyNodeSnapshot(from, to, id, node); err != nil {
+				return err
+			}
+			if !contains(copied, id) {
+				copied = append(copied, id)
+			}
+		}
+		if err := copyNodeSnapshot(from, to, snapshotID, node); err != nil {
+			return err
+		}
+		if baseID != "" {
+			if err := to.copyChain(from, baseID, node); err != nil {
+				return errors.Wrapf(err, "destination [%s]", to)
+			}
+		}
+	}
+
+	// nodes copied in earlier runs count too, the marker is only written once all of them are present
+	for _, id := range copied {
+		if !from.IsClusterSnapshotComplete(id) {
+			continue
+		}
+		complete, err := to.MarkClusterSnapshotComplete(id, from.ListNodes(id))
+		if err != nil {
+			return errors.Wrapf(err, "destination [%s]", to)
+		}
+		if complete {
+			log.Infof("marked cluster snapshot [%s] complete on [%s]", id, to)
+		}
+	}
+
+	return nil
+}
+
+// checkComplete refuses to copy a node snapshot missing its completion marker unless forced
+func checkComplete(remote *Remote, snapshotID, node string, force bool) error {
+	if remote.IsSnapshotComplete(filepath.Join(SnapshotFolderPrefix, snapshotID, node)) {
+		return nil
+	}
+	if !force {
+		return errors.Errorf("snapshot [%s] is incomplete for node [%s], use --force to copy it anyway", snapshotID, node)
+	}
+	log.Warnf("snapshot [%s] is incomplete for node [%s], copying anyway", snapshotID, node)
+	return nil
+}
+
+// chainLinks returns the snapshots a node snapshot is restored on top of, its base snapshot followed
+// by the earlier incremental backups, and the base snapshot whose chain it belongs to. Snapshots taken
+// without a manifest have no chain.
+func chainLinks(remote *Remote, snapshotID, node string) ([]string, string, error) {
+	manifest, err := remote.ReadManifest(snapshotID, node)
+	if err == ErrNotExist {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if manifest.Base == "" {
+		return nil, snapshotID, nil
+	}
+
+	manifests, err := remote.LoadChain(snapshotID, node)
+	if err != nil {
+		return nil, "", err
+	}
+	var links []string
+	for _, m := range manifests[:len(manifests)-1] {
+		links = append(links, m.SnapshotID)
+	}
+	return links, manifest.Base, nil
+}
+
+// copyNodeSnapshot copies every object of a node snapshot and the shared objects it references,
+// then writes the completion marker when the snapshot is complete on the source
+func copyNodeSnapshot(from, to *Remote, snapshotID, node string) error {
+	var (
+		totalSize, copiedSize int64
+		snapshotFolder        = filepath.Join(SnapshotFolderPrefix, snapshotID)
+	)
+
+	listing, err := from.Storage().List(filepath.Join(snapshotFolder, node)+"/", "")
+	if err != nil {
+		return err
+	}
+	objects, err := sharedObjects(from, snapshotID, node)
+	if err != nil {
+		return err
+	}
+	objects = append(objects, listing.Objects...)
+	for _, obj := range objects {
+		totalSize += obj.Size
+	}
+
+	log.Infof("copying snapshot [%s] of node [%s] from [%s] to [%s]", snapshotID, node, from, to)
+	bar := pb.New64(totalSize)
+	bar.SetUnits(pb.U_BYTES)
+	bar.Start()
+	bar.ShowSpeed = true
+
+	for _, obj := range objects {
+		// the marker is written last, once everything else is in place, and the chain
+		// only lists the incremental backups the destination holds
+		if name := path.Base(obj.Key); name == SnapshotCompleted || name == ChainFilename {
+			continue
+		}
+		copied, err := to.CopyFrom(from, obj)
+		if err != nil {
+			bar.Finish()
+			return errors.Wrapf(err, "error copying %s", obj.Key)
+		}
+		if copied {
+			copiedSize += obj.Size
+		}
+		bar.Add64(obj.Size)
+	}
+	bar.Finish()
+
+	if from.IsSnapshotComplete(filepath.Join(snapshotFolder, node)) && !to.MarkSnapshotComplete(snapshotFolder, node) {
+		return errors.Errorf("unable to mark node [%s] complete on [%s]", node, to)
+	}
+	log.Infof("copied %s for node [%s], skipped %s already present", humanize.Bytes(uint64(copiedSize)), node, humanize.Bytes(uint64(totalSize-copiedSize)))
+	return nil
+}
+
+// copyChain writes the chain of a base snapshot to the destination, listing only the incremental
+// backups the destination holds complete. Incremental backups taken directly on the destination stay in its chain.
+func (r *Remote) copyChain(src *Remote, baseID, node string) error {
+	source, err := src.ReadChain(baseID, node)
+	if err != nil {
+		return err
+	}
+	existing, err := r.ReadChain(baseID, node)
+	if err != nil {
+		return err
+	}
+
+	chain := &Chain{Base: baseID}
+	for _, id := range source.Incrementals {
+		if r.IsSnapshotComplete(filepath.Join(SnapshotFolderPrefix, id, node)) {
+			chain.Incrementals = append(chain.Incrementals, id)
+		}
+	}
+	for _, id := range existing.Incrementals {
+		if !contains(chain.Incrementals, id) {
+			chain.Incrementals = append(chain.Incrementals, id)
+		}
+	}
+	if len(chain.Incrementals) == 0 || reflect.DeepEqual(chain.Incrementals, existing.Incrementals) {
+		return nil
+	}
+	return r.writeChain(node, chain)
+}
+
+// sharedObjects returns the deduplicated objects referenced by the manifest of a node snapshot
+func sharedObjects(remote *Remote, snapshotID, node string) ([]ObjectInfo, error) {
+	var (
+		objects []ObjectInfo
+		seen    = make(map[string]bool)
+	)
+
+	manifest, err := remote.ReadManifest(snapshotID, node)
+	if err == ErrNotExist {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range manifest.Files {
+		// compressed and encrypted objects of the snapshot itself are already in its listing
+		if !isShared(file) || seen[file.Object] {
+			continue
+		}
+		seen[file.Object] = true
+		objects = append(objects, ObjectInfo{Key: file.Object, Size: file.ObjectSize()})
+	}
+	return objects, nil
+}
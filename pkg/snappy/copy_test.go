@@ -0,0 +1,172 @@
+package snappy
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// metadataStorage keeps the metadata of objects stored on a Filesystem, which does not store metadata itself
+type metadataStorage struct {
+	*Filesystem
+	metadata map[string]map[string]string
+}
+
+func (m *metadataStorage) Put(key string, body io.Reader, opts PutOptions) error {
+	m.metadata[key] = opts.Metadata
+	return m.Filesystem.Put(key, body, opts)
+}
+
+func (m *metadataStorage) Head(key string) (*ObjectInfo, error) {
+	info, err := m.Filesystem.Head(key)
+	if err != nil {
+		return nil, err
+	}
+	info.Metadata = m.metadata[key]
+	return info, nil
+}
+
+// testMetadataRemote returns a remote storing objects and their metadata in a temporary directory
+func testMetadataRemote(t *testing.T) *Remote {
+	t.Helper()
+	fs, err := NewFilesystem(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewRemote("file://"+fs.root, &metadataStorage{Filesystem: fs, metadata: make(map[string]map[string]string)})
+}
+
+func TestCopyFromComparesChecksums(t *testing.T) {
+	tests := []struct {
+		name       string
+		existing   []byte
+		checksum   string
+		wantCopied bool
+	}{
+		{"missing object", nil, "", true},
+		{"same size and checksum", []byte("data"), "a", false},
+		{"same size, other checksum", []byte("atad"), "b", true},
+		{"same size without checksum", []byte("atad"), "", false},
+		{"other size", []byte("more data"), "a", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst := testMetadataRemote(t), testMetadataRemote(t)
+			const key = "backups/s1/10.0.0.1/ks1/t1-aaa/mc-1-big-Data.db"
+			if err := src.storage.Put(key, bytes.NewReader([]byte("data")), PutOptions{Metadata: map[string]string{MetadataChecksum: "a"}}); err != nil {
+				t.Fatal(err)
+			}
+			if tt.existing != nil {
+				var metadata map[string]string
+				if tt.checksum != "" {
+					metadata = map[string]string{MetadataChecksum: tt.checksum}
+				}
+				if err := dst.storage.Put(key, bytes.NewReader(tt.existing), PutOptions{Metadata: metadata}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			copied, err := dst.CopyFrom(src, ObjectInfo{Key: key, Size: 4})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if copied != tt.wantCopied {
+				t.Errorf("copied is %t, expected %t", copied, tt.wantCopied)
+			}
+			if info, _ := dst.storage.Head(key); tt.wantCopied && info.Metadata[MetadataChecksum] != "a" {
+				t.Errorf("copied object has checksum %q, expected a", info.Metadata[MetadataChecksum])
+			}
+		})
+	}
+}
+
+// putNodeSnapshot stores a complete node snapshot of 10.0.0.1 holding the given files
+func putNodeSnapshot(t *testing.T, remote *Remote, snapshotID, base string, names ...string) {
+	t.Helper()
+	manifest := testManifest(snapshotID, base, names...)
+	for _, file := range manifest.Files {
+		putObject(t, remote, file.Key, []byte(file.Path()))
+	}
+	if err := remote.WriteManifest(manifest); err != nil {
+		t.Fatal(err)
+	}
+	if base != "" {
+		if err := remote.AppendChain(base, "10.0.0.1", snapshotID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	remote.MarkSnapshotComplete("backups/"+snapshotID, "10.0.0.1")
+}
+
+func TestCopySnapshotChain(t *testing.T) {
+	var (
+		srcConfig = &StorageConfig{Destination: "file://" + t.TempDir()}
+		dstConfig = &StorageConfig{Destination: "file://" + t.TempDir()}
+	)
+	src, err := OpenRemote(srcConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := OpenRemote(dstConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putNodeSnapshot(t, src, "s1", "", "mc-1-big-Data.db")
+	putNodeSnapshot(t, src, "s2", "s1", "mc-2-big-Data.db")
+	putNodeSnapshot(t, src, "s3", "s1", "mc-3-big-Data.db")
+
+	steps := []struct {
+		snapshotID string
+		complete   []string
+		chain      []string
+	}{
+		// the base of an incremental backup is copied with it, the chain leaves out s3
+		{"s2", []string{"s1", "s2"}, []string{"s2"}},
+		{"s3", []string{"s1", "s2", "s3"}, []string{"s2", "s3"}},
+	}
+	for _, step := range steps {
+		if err := CopySnapshot(srcConfig, dstConfig, step.snapshotID, nil, false); err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range step.complete {
+			if !dst.IsSnapshotComplete("backups/" + id + "/10.0.0.1") {
+				t.Errorf("after copying %s, snapshot %s is not complete on the destination", step.snapshotID, id)
+			}
+		}
+		chain, err := dst.ReadChain("s1", "10.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(chain.Incrementals, step.chain) {
+			t.Errorf("after copying %s, the chain is %v, expected %v", step.snapshotID, chain.Incrementals, step.chain)
+		}
+		manifests, err := dst.LoadChain(step.snapshotID, "10.0.0.1")
+		if err != nil {
+			t.Fatalf("%s cannot be restored from the destination: %v", step.snapshotID, err)
+		}
+		if len(manifests) != len(step.complete) {
+			t.Errorf("%s is restored from %d snapshots, expected %d", step.snapshotID, len(manifests), len(step.complete))
+		}
+	}
+}
+
+func TestCopySnapshotIncompleteBase(t *testing.T) {
+	var (
+		srcConfig = &StorageConfig{Destination: "file://" + t.TempDir()}
+		dstConfig = &StorageConfig{Destination: "file://" + t.TempDir()}
+	)
+	src, err := OpenRemote(srcConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putNodeSnapshot(t, src, "s1", "", "mc-1-big-Data.db")
+	putNodeSnapshot(t, src, "s2", "s1", "mc-2-big-Data.db")
+	if err := src.storage.Delete("backups/s1/10.0.0.1/" + SnapshotCompleted); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CopySnapshot(srcConfig, dstConfig, "s2", nil, false); err == nil {
+		t.Error("incremental backup of an incomplete base snapshot was copied")
+	}
+}
@@ -0,0 +1,84 @@
+package snappy
+
+import (
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Encoding describes how a file is transformed while it is uploaded, it is compressed first and then encrypted
+type Encoding struct {
+	Compression Compression
+	// Keyring encrypts the file when it is set
+	Keyring *Keyring
+}
+
+// Identity reports whether files are uploaded as they are
+func (e Encoding) Identity() bool {
+	return e.Compression.Codec == "" && e.Keyring == nil
+}
+
+// Extension returns the suffix of the keys of objects written with the encoding
+func (e Encoding) Extension() string {
+	ext := e.Compression.Extension()
+	if e.Keyring != nil {
+		ext += EncryptedExtension
+	}
+	return ext
+}
+
+// KeyID returns the id of the master key objects are encrypted with, empty when they are not encrypted
+func (e Encoding) KeyID() string {
+	if e.Keyring == nil {
+		return ""
+	}
+	return e.Keyring.KeyID()
+}
+
+// Reader encodes everything read from reader, the returned reader must be closed
+// to release the encoder when it is not read until the end
+func (e Encoding) Reader(reader io.Reader) (io.ReadCloser, error) {
+	compressed, err := e.Compression.Reader(reader)
+	if err != nil {
+		return nil, err
+	}
+	if e.Keyring == nil {
+		return compressed, nil
+	}
+
+	encrypted, err := e.Keyring.Encrypt(compressed)
+	if err != nil {
+		compressed.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{encrypted, compressed}, nil
+}
+
+// decodeReader reverses the encoding of an object, keyring is only needed for encrypted objects
+func decodeReader(reader io.Reader, codec, keyID string, keyring *Keyring) (io.ReadCloser, error) {
+	if keyID != "" {
+		if keyring == nil {
+			return nil, errors.Errorf("object is encrypted with key [%s], a key is needed to restore it", keyID)
+		}
+		decrypted, err := keyring.Decrypt(reader)
+		if err != nil {
+			return nil, err
+		}
+		reader = decrypted
+	}
+	return decompressReader(codec, reader)
+}
+
+// encodingFromKey returns the codec of an object and whether it is encrypted from the extensions of its key,
+// along with the key of the file without them
+func encodingFromKey(key string) (string, bool, string) {
+	encrypted := strings.HasSuffix(key, EncryptedExtension)
+	key = strings.TrimSuffix(key, EncryptedExtension)
+
+	codec := codecFromKey(key)
+	return codec, encrypted, strings.TrimSuffix(key, codecExtensions[codec])
+}
@@ -0,0 +1,401 @@
+package snappy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/external"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/pkg/errors"
+)
+
+const (
+	// EncryptedExtension is appended to the key of encrypted objects
+	EncryptedExtension = ".enc"
+
+	// encryptionMagic starts every encrypted object, the last byte is the format version
+	encryptionMagic = "SNAPPYE\x01"
+	// encryptionChunkSize is the plaintext size of each sealed chunk
+	encryptionChunkSize = 64 * 1024
+	// encryptionPrefixSize is the random part of the chunk nonces, the rest is a counter and the last chunk flag
+	encryptionPrefixSize = 7
+	dataKeySize          = 32
+
+	// dedupKeyLabel derives the key shared object names are computed with from a master key
+	dedupKeyLabel = "snappy shared object names"
+
+	localKeyPrefix = "local:"
+	kmsKeyPrefix   = "kms:"
+)
+
+// MasterKey wraps the random data key every object is encrypted with
+type MasterKey interface {
+	// ID identifies the key, it is stored with every object so the key can be found again after rotation
+	ID() string
+	// Wrap encrypts a data key
+	Wrap(dataKey []byte) ([]byte, error)
+	// Unwrap decrypts a data key wrapped by this key
+	Unwrap(wrapped []byte) ([]byte, error)
+}
+
+// Keyring holds the master keys of a backup. New objects are encrypted with the first key,
+// the others are only used to decrypt objects written before a key was rotated.
+type Keyring struct {
+	keys []MasterKey
+}
+
+// NewKeyring returns a keyring encrypting with the first of keys
+func NewKeyring(keys ...MasterKey) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("a keyring needs at least one key")
+	}
+	return &Keyring{keys: keys}, nil
+}
+
+// KeyID returns the id of the key new objects are encrypted with
+func (k *Keyring) KeyID() string {
+	return k.keys[0].ID()
+}
+
+// key returns the master key with id, KMS decrypts data keys wrapped by any of its keys
+func (k *Keyring) key(id string) (MasterKey, error) {
+	for _, key := range k.keys {
+		if key.ID() == id {
+			return key, nil
+		}
+	}
+	if strings.HasPrefix(id, kmsKeyPrefix) {
+		for _, key := range k.keys {
+			if strings.HasPrefix(key.ID(), kmsKeyPrefix) {
+				return key, nil
+			}
+		}
+	}
+	return nil, errors.Errorf("object was encrypted with key [%s] which is not in the keyring", id)
+}
+
+// ValidateDedup checks the names of deduplicated objects can be derived from the current master key
+func (k *Keyring) ValidateDedup() error {
+	_, err := k.dedupKey()
+	return err
+}
+
+// SharedName returns the name of the shared object holding an encrypted file, the hmac of its checksum.
+// Names of encrypted objects do not reveal the checksum of their plaintext, and change when the key is rotated.
+func (k *Keyring) SharedName(checksum string) (string, error) {
+	key, err := k.dedupKey()
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(checksum))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// dedupKey returns the key shared object names are derived from, KMS keys never leave KMS so only keys read from a file have one
+func (k *Keyring) dedupKey() ([]byte, error) {
+	local, ok := k.keys[0].(*localKey)
+	if !ok {
+		return nil, errors.Errorf("deduplication needs a key file, names of shared objects cannot be derived from key [%s]", k.KeyID())
+	}
+	return local.dedupKey, nil
+}
+
+// localKey is a 256 bit master key read from a file
+type localKey struct {
+	id       string
+	aead     cipher.AEAD
+	dedupKey []byte
+}
+
+// LoadKeyFile reads a 256 bit master key from a file, either as 32 raw bytes or hex or base64 encoded
+func LoadKeyFile(filename string) (MasterKey, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	key := data
+	if len(key) != dataKeySize {
+		text := strings.TrimSpace(string(data))
+		if key, err = hex.DecodeString(text); err != nil || len(key) != dataKeySize {
+			key, err = base64.StdEncoding.DecodeString(text)
+		}
+		if err != nil || len(key) != dataKeySize {
+			return nil, errors.Errorf("key file %s must hold a 256 bit key, as raw bytes or hex or base64 encoded", filename)
+		}
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	// the id is derived from the key, it tells which file is needed without revealing the key
+	sum := sha256.Sum256(key)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(dedupKeyLabel))
+	return &localKey{id: localKeyPrefix + hex.EncodeToString(sum[:8]), aead: aead, dedupKey: mac.Sum(nil)}, nil
+}
+
+func (k *localKey) ID() string {
+	return k.id
+}
+
+func (k *localKey) Wrap(dataKey []byte) ([]byte, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return k.aead.Seal(nonce, nonce, dataKey, []byte(k.id)), nil
+}
+
+func (k *localKey) Unwrap(wrapped []byte) ([]byte, error) {
+	size := k.aead.NonceSize()
+	if len(wrapped) < size {
+		return nil, errors.New("wrapped data key is too short")
+	}
+	dataKey, err := k.aead.Open(nil, wrapped[:size], wrapped[size:], []byte(k.id))
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to unwrap data key with [%s]", k.id)
+	}
+	return dataKey, nil
+}
+
+// kmsKey wraps data keys with an AWS KMS key
+type kmsKey struct {
+	keyID string
+	svc   *kms.KMS
+}
+
+// NewKMSKey uses the AWS KMS key with keyID, an id, arn or alias, to wrap data keys. The key is
+// used in the region of its arn, or the default region of the AWS config for ids and aliases.
+func NewKMSKey(keyID string) (MasterKey, error) {
+	cfg, err := external.LoadDefaultAWSConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to load SDK config")
+	}
+	// arn:aws:kms:<region>:<account>:key/<id>
+	if parts := strings.Split(keyID, ":"); len(parts) > 3 && parts[0] == "arn" {
+		cfg.Region = parts[3]
+	}
+	return &kmsKey{keyID: keyID, svc: kms.New(cfg)}, nil
+}
+
+func (k *kmsKey) ID() string {
+	return kmsKeyPrefix + k.keyID
+}
+
+func (k *kmsKey) Wrap(dataKey []byte) ([]byte, error) {
+	req := k.svc.EncryptRequest(&kms.EncryptInput{KeyId: aws.String(k.keyID), Plaintext: dataKey})
+	result, err := req.Send()
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to wrap data key with kms key [%s]", k.keyID)
+	}
+	return result.CiphertextBlob, nil
+}
+
+func (k *kmsKey) Unwrap(wrapped []byte) ([]byte, error) {
+	req := k.svc.DecryptRequest(&kms.DecryptInput{CiphertextBlob: wrapped})
+	result, err := req.Send()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to unwrap data key with kms")
+	}
+	return result.Plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of a chunk, the counter keeps chunks from being reordered and
+// the last chunk flag keeps an object from being truncated at a chunk boundary
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptionPrefixSize:], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// Encrypt returns a reader encrypting everything read from reader with AES-256-GCM under a new data key.
+// The data key is wrapped by the first key of the keyring and stored in the header of the object.
+func (k *Keyring) Encrypt(reader io.Reader) (io.Reader, error) {
+	dataKey := make([]byte, dataKeySize)
+	prefix := make([]byte, encryptionPrefixSize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+
+	wrapped, err := k.keys[0].Wrap(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var header bytes.Buffer
+	header.WriteString(encryptionMagic)
+	writeField(&header, []byte(k.KeyID()))
+	writeField(&header, wrapped)
+	header.Write(prefix)
+
+	return &encryptReader{reader: reader, aead: aead, prefix: prefix, out: header.Bytes()}, nil
+}
+
+// encryptReader seals the plaintext read from reader in chunks
+type encryptReader struct {
+	reader  io.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	out     []byte
+	done    bool
+}
+
+func (e *encryptReader) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+
+		chunk := make([]byte, encryptionChunkSize)
+		n, err := io.ReadFull(e.reader, chunk)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return 0, err
+		}
+		e.out = e.aead.Seal(nil, chunkNonce(e.prefix, e.counter, last), chunk[:n], nil)
+		e.counter++
+		e.done = last
+	}
+
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+// Decrypt returns a reader decrypting an object written by Encrypt, the data key is
+// unwrapped with the key of the keyring named in the header of the object
+func (k *Keyring) Decrypt(reader io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(reader)
+
+	magic := make([]byte, len(encryptionMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != encryptionMagic {
+		return nil, errors.New("object is not encrypted by snappy or uses an unknown format")
+	}
+	keyID, err := readField(br)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := readField(br)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, encryptionPrefixSize)
+	if _, err := io.ReadFull(br, prefix); err != nil {
+		return nil, errors.Wrap(err, "truncated encryption header")
+	}
+
+	key, err := k.key(string(keyID))
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := key.Unwrap(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{reader: br, aead: aead, prefix: prefix}, nil
+}
+
+// decryptReader opens the chunks of an encrypted object
+type decryptReader struct {
+	reader  *bufio.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	out     []byte
+	done    bool
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+
+		sealed := make([]byte, encryptionChunkSize+d.aead.Overhead())
+		n, err := io.ReadFull(d.reader, sealed)
+		if err == io.EOF {
+			return 0, errors.New("encrypted object is truncated")
+		}
+		last := err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return 0, err
+		}
+		if !last {
+			// a full chunk is the last one when nothing follows it
+			if _, err := d.reader.Peek(1); err == io.EOF {
+				last = true
+			}
+		}
+
+		d.out, err = d.aead.Open(nil, chunkNonce(d.prefix, d.counter, last), sealed[:n], nil)
+		if err != nil {
+			return 0, errors.Wrapf(err, "encrypted object is corrupt or truncated at chunk %d", d.counter)
+		}
+		d.counter++
+		d.done = last
+	}
+
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+// writeField writes a length prefixed field of the encryption header
+func writeField(w *bytes.Buffer, field []byte) {
+	var size [2]byte
+	binary.BigEndian.PutUint16(size[:], uint16(len(field)))
+	w.Write(size[:])
+	w.Write(field)
+}
+
+// readField reads a length prefixed field of the encryption header
+func readField(r io.Reader) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, errors.Wrap(err, "truncated encryption header")
+	}
+	field := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(r, field); err != nil {
+		return nil, errors.Wrap(err, "truncated encryption header")
+	}
+	return field, nil
+}
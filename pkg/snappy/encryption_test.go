@@ -0,0 +1,168 @@
+package snappy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// testKey writes a random master key to a key file and loads it
+func testKey(t *testing.T) MasterKey {
+	t.Helper()
+	raw := make([]byte, dataKeySize)
+	if _, err := rand.Read(raw); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "backup.key")
+	if err := ioutil.WriteFile(filename, []byte(hex.EncodeToString(raw)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key, err := LoadKeyFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// testKeyring returns a keyring encrypting with the first of keys
+func testKeyring(t *testing.T, keys ...MasterKey) *Keyring {
+	t.Helper()
+	keyring, err := NewKeyring(keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+// encrypt returns plaintext encrypted by keyring
+func encrypt(t *testing.T, keyring *Keyring, plaintext []byte) []byte {
+	t.Helper()
+	reader, err := keyring.Encrypt(bytes.NewReader(plaintext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sealed
+}
+
+// decrypt returns the plaintext of sealed, or the error of the first read that failed
+func decrypt(keyring *Keyring, sealed []byte) ([]byte, error) {
+	reader, err := keyring.Decrypt(bytes.NewReader(sealed))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(reader)
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	keyring := testKeyring(t, testKey(t))
+
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"one byte", 1},
+		{"partial chunk", encryptionChunkSize - 1},
+		{"exact chunk", encryptionChunkSize},
+		{"chunk and a byte", encryptionChunkSize + 1},
+		{"exact multiple of chunks", 3 * encryptionChunkSize},
+		{"several chunks", 3*encryptionChunkSize + 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plaintext := make([]byte, tt.size)
+			rand.Read(plaintext)
+
+			sealed := encrypt(t, keyring, plaintext)
+			// a few random bytes can appear in the ciphertext by chance
+			if tt.size >= 16 && bytes.Contains(sealed, plaintext) {
+				t.Fatal("encrypted object contains the plaintext")
+			}
+			decrypted, err := decrypt(keyring, sealed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decrypted, plaintext) {
+				t.Fatalf("decrypted %d bytes do not match the %d bytes encrypted", len(decrypted), len(plaintext))
+			}
+		})
+	}
+}
+
+func TestDecryptDetectsTampering(t *testing.T) {
+	keyring := testKeyring(t, testKey(t))
+	plaintext := make([]byte, 2*encryptionChunkSize)
+	rand.Read(plaintext)
+	sealed := encrypt(t, keyring, plaintext)
+	// the empty last chunk that follows an exact multiple of chunks is only the gcm tag
+	lastChunk := len(sealed) - 16
+
+	tests := []struct {
+		name   string
+		tamper func([]byte) []byte
+	}{
+		{"flipped bit", func(b []byte) []byte {
+			b[len(b)/2] ^= 1
+			return b
+		}},
+		{"flipped tag", func(b []byte) []byte {
+			b[len(b)-1] ^= 1
+			return b
+		}},
+		{"truncated chunk", func(b []byte) []byte { return b[:len(b)-10] }},
+		{"dropped last chunk", func(b []byte) []byte { return b[:lastChunk] }},
+		{"appended data", func(b []byte) []byte { return append(b, 0) }},
+		{"no header", func(b []byte) []byte { return b[:4] }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tampered := tt.tamper(append([]byte(nil), sealed...))
+			if _, err := decrypt(keyring, tampered); err == nil {
+				t.Fatal("tampered object was decrypted without an error")
+			}
+		})
+	}
+}
+
+func TestDecryptKeyRotation(t *testing.T) {
+	oldKey, newKey := testKey(t), testKey(t)
+	plaintext := []byte("sstable written before the key was rotated")
+	sealed := encrypt(t, testKeyring(t, oldKey), plaintext)
+
+	decrypted, err := decrypt(testKeyring(t, newKey, oldKey), sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Fatalf("decrypted %q, expected %q", decrypted, plaintext)
+	}
+	if _, err := decrypt(testKeyring(t, newKey), sealed); err == nil {
+		t.Fatal("object was decrypted without the key it was encrypted with")
+	}
+}
+
+func TestSharedName(t *testing.T) {
+	key, other := testKey(t), testKey(t)
+	checksum := "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+	name, err := testKeyring(t, key).SharedName(checksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name == checksum || len(name) != len(checksum) {
+		t.Fatalf("shared name %s reveals or does not look like a checksum", name)
+	}
+	if again, _ := testKeyring(t, key, other).SharedName(checksum); again != name {
+		t.Errorf("shared name is %s with the same key, expected %s", again, name)
+	}
+	if rotated, _ := testKeyring(t, other, key).SharedName(checksum); rotated == name {
+		t.Error("shared name did not change with the master key")
+	}
+}
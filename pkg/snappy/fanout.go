@@ -0,0 +1,285 @@
+package snappy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// fanoutChunkSize is the amount of data read from disk before it is handed to every destination
+const fanoutChunkSize = 1024 * 1024
+
+// Fanout uploads every file to several remotes while reading it from disk only once.
+// A remote that fails an upload is excluded from the rest of the backup, the others carry on.
+// Files can be uploaded from several goroutines at the same time.
+type Fanout struct {
+	remotes []*Remote
+	mu      sync.Mutex
+	errs    []error
+}
+
+// NewFanout streams uploads to all remotes
+func NewFanout(remotes []*Remote) *Fanout {
+	return &Fanout{
+		remotes: remotes,
+		errs:    make([]error, len(remotes)),
+	}
+}
+
+// active returns the indexes of the remotes that have not failed yet
+func (f *Fanout) active() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var active []int
+	for i, err := range f.errs {
+		if err == nil {
+			active = append(active, i)
+		}
+	}
+	return active
+}
+
+// UploadFile sends a local file and its metadata to every remote still active, and returns the size of
+// the stored object and the sha256 of the file, computed while it is read. It only returns an error once
+// no remote is able to receive uploads anymore.
+func (f *Fanout) UploadFile(filename string, key string, metadata map[string]string, encoding Encoding) (int64, string, error) {
+	active := f.active()
+	if len(active) == 0 {
+		return 0, "", errors.New("all destinations have failed")
+	}
+	return f.upload(active, filename, key, metadata, encoding)
+}
+
+// UploadShared sends a content addressed file only to the remotes that do not store it yet. It returns
+// the size of the stored object, the key id recorded in the metadata of the object when it was already
+// stored everywhere, and whether the file had to be uploaded anywhere.
+func (f *Fanout) UploadShared(filename string, key string, size int64, metadata map[string]string, encoding Encoding) (int64, string, bool, error) {
+	active := f.active()
+	if len(active) == 0 {
+		return 0, "", false, errors.New("all destinations have failed")
+	}
+
+	var (
+		missing []int
+		stored  int64
+		keyID   string
+	)
+	for _, idx := range active {
+		// the size of an encoded object is not known up front, the key already names the encoding
+		if info, err := f.remotes[idx].storage.Head(key); err == nil && (!encoding.Identity() || info.Size == size) {
+			stored = info.Size
+			keyID = info.Metadata[MetadataKeyID]
+			continue
+		}
+		missing = append(missing, idx)
+	}
+	if len(missing) == 0 {
+		log.Debugf("file [%s] is already stored as [%s], skipping", filename, key)
+		return stored, keyID, false, nil
+	}
+	stored, _, err := f.upload(missing, filename, key, metadata, encoding)
+	return stored, "", true, err
+}
+
+// upload streams a local file to the remotes at the given indexes, encoding it on the way,
+// and returns the size of the stored object and the sha256 of the file
+func (f *Fanout) upload(active []int, filename string, key string, metadata map[string]string, encoding Encoding) (int64, string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		log.Fatal(err)
+	}
+	size := fi.Size()
+
+	log.Debugf("uploading file [%s] -> [%s] to %d destinations", filename, key, len(active))
+
+	// the file is hashed as it is read, so it is only read from disk once
+	sum := sha256.New()
+	reader, err := encoding.Reader(io.TeeReader(DiskLimiter.Reader(file), sum))
+	if err != nil {
+		return 0, "", err
+	}
+	defer reader.Close()
+
+	var (
+		wg      sync.WaitGroup
+		readers = make([]*io.PipeReader, len(active))
+		writers = make([]*io.PipeWriter, len(active))
+		putErrs = make([]error, len(active))
+	)
+	for i, idx := range active {
+		readers[i], writers[i] = io.Pipe()
+		wg.Add(1)
+		go func(i int, remote *Remote) {
+			defer wg.Done()
+			putErrs[i] = remote.storage.Put(key, NetworkLimiter.Reader(readers[i]), remote.putOptions(size, metadata))
+			// unblock the writer if the upload stopped reading early
+			readers[i].CloseWithError(errors.New("upload aborted"))
+		}(i, f.remotes[idx])
+	}
+
+	stored, readErr := f.copy(reader, writers)
+	for _, w := range writers {
+		w.CloseWithError(readErr)
+	}
+	wg.Wait()
+
+	if readErr != nil {
+		return 0, "", errors.Wrapf(readErr, "error reading %s", filename)
+	}
+
+	f.mu.Lock()
+	for i, idx := range active {
+		if putErrs[i] != nil && f.errs[idx] == nil {
+			f.errs[idx] = errors.Wrapf(putErrs[i], "error uploading %s", filename)
+			log.Errorf("destination [%s] failed and will be skipped: %v", f.remotes[idx], f.errs[idx])
+		}
+	}
+	f.mu.Unlock()
+	if len(f.active()) == 0 {
+		return 0, "", errors.New("all destinations have failed")
+	}
+	return stored, hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// copy reads chunks from reader and writes each chunk to all writers concurrently, returning
+// the number of bytes read. Writers that fail are dropped while the others keep receiving data.
+func (f *Fanout) copy(reader io.Reader, writers []*io.PipeWriter) (int64, error) {
+	var (
+		buf    = make([]byte, fanoutChunkSize)
+		failed = make([]bool, len(writers))
+		total  int64
+	)
+
+	for {
+		n, err := io.ReadFull(reader, buf)
+		total += int64(n)
+		if n > 0 {
+			var wg sync.WaitGroup
+			for i, w := range writers {
+				if failed[i] {
+					continue
+				}
+				wg.Add(1)
+				go func(i int, w *io.PipeWriter) {
+					defer wg.Done()
+					if _, err := w.Write(buf[:n]); err != nil {
+						failed[i] = true
+					}
+				}(i, w)
+			}
+			wg.Wait()
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// WriteManifest uploads the node manifest to every remote that received all files
+func (f *Fanout) WriteManifest(manifest *Manifest) {
+	for _, idx := range f.active() {
+		remote := f.remotes[idx]
+		if err := remote.WriteManifest(manifest); err != nil {
+			f.errs[idx] = err
+			log.Errorf("destination [%s] failed to write the manifest: %v", remote, err)
+		}
+	}
+}
+
+// WriteSchema uploads the schema of the node snapshot to every remote that received all files
+func (f *Fanout) WriteSchema(snapshotID, node string, schema []byte, keyring *Keyring) {
+	for _, idx := range f.active() {
+		remote := f.remotes[idx]
+		if err := remote.WriteSchema(snapshotID, node, schema, keyring); err != nil {
+			f.errs[idx] = err
+			log.Errorf("destination [%s] failed to write the schema: %v", remote, err)
+		}
+	}
+}
+
+// MarkSnapshotComplete writes the completion marker to every remote that received all files
+func (f *Fanout) MarkSnapshotComplete(prefix, snapshotID string) {
+	for _, idx := range f.active() {
+		remote := f.remotes[idx]
+		if !remote.MarkSnapshotComplete(prefix, snapshotID) {
+			f.errs[idx] = errors.New("unable to write completion marker")
+			log.Errorf("destination [%s] failed to mark snapshot complete", remote)
+		}
+	}
+}
+
+// IsSnapshotComplete reports whether every remote holds the completion marker at path
+func (f *Fanout) IsSnapshotComplete(path string) bool {
+	for _, remote := range f.remotes {
+		if !remote.IsSnapshotComplete(path) {
+			return false
+		}
+	}
+	return true
+}
+
+// MarkClusterSnapshotComplete writes the cluster completion marker to every remote
+// where all ring members, given by host id, have completed the snapshot
+func (f *Fanout) MarkClusterSnapshotComplete(snapshotID string, hostIDs []string) {
+	for _, idx := range f.active() {
+		remote := f.remotes[idx]
+		members, missing := remote.ringNodes(snapshotID, hostIDs)
+		if len(missing) > 0 {
+			log.Infof("snapshot [%s] on [%s] is waiting for %d other nodes to complete", snapshotID, remote, len(missing))
+			continue
+		}
+		complete, err := remote.MarkClusterSnapshotComplete(snapshotID, members)
+		if err != nil {
+			f.errs[idx] = err
+			log.Errorf("destination [%s] failed to mark cluster snapshot complete: %v", remote, err)
+			continue
+		}
+		if complete {
+			log.Infof("all %d nodes completed snapshot [%s] on [%s], marked cluster snapshot complete", len(members), snapshotID, remote)
+		} else {
+			log.Infof("snapshot [%s] on [%s] is waiting for other nodes to complete", snapshotID, remote)
+		}
+	}
+}
+
+// AppendChain records an incremental backup in the chain of its base snapshot on every remote that received it
+func (f *Fanout) AppendChain(baseID, node, snapshotID string) {
+	for _, idx := range f.active() {
+		remote := f.remotes[idx]
+		if err := remote.AppendChain(baseID, node, snapshotID); err != nil {
+			f.errs[idx] = err
+			log.Errorf("destination [%s] failed to record the incremental backup: %v", remote, err)
+		}
+	}
+}
+
+// Err reports every destination that failed, or nil when all of them succeeded
+func (f *Fanout) Err() error {
+	var err error
+	for idx, e := range f.errs {
+		if e == nil {
+			continue
+		}
+		if err == nil {
+			err = errors.Errorf("destination [%s]: %v", f.remotes[idx], e)
+		} else {
+			err = errors.Errorf("%v; destination [%s]: %v", err, f.remotes[idx], e)
+		}
+	}
+	return err
+}
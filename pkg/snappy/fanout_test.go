@@ -0,0 +1,24 @@
+package snappy
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestFanoutIsSnapshotComplete(t *testing.T) {
+	first, second := testRemote(t), testRemote(t)
+	fanout := NewFanout([]*Remote{first, second})
+	prefix := filepath.Join(SnapshotFolderPrefix, "s1")
+
+	if fanout.IsSnapshotComplete(filepath.Join(prefix, "10.0.0.1")) {
+		t.Fatal("snapshot is complete before any destination holds it")
+	}
+	first.MarkSnapshotComplete(prefix, "10.0.0.1")
+	if fanout.IsSnapshotComplete(filepath.Join(prefix, "10.0.0.1")) {
+		t.Error("snapshot is complete while the second destination lacks its marker")
+	}
+	second.MarkSnapshotComplete(prefix, "10.0.0.1")
+	if !fanout.IsSnapshotComplete(filepath.Join(prefix, "10.0.0.1")) {
+		t.Error("snapshot is not complete once every destination holds its marker")
+	}
+}
@@ -0,0 +1,204 @@
+package snappy
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// tempFilePrefix marks files that are still being written to a Filesystem
+const tempFilePrefix = ".snappy-"
+
+// Filesystem stores backups in a local directory such as an NFS mount,
+// using the same key layout as the object store backends
+type Filesystem struct {
+	root string
+}
+
+// NewFilesystem returns a Filesystem rooted at directory, which must already exist
+func NewFilesystem(directory string) (*Filesystem, error) {
+	if !filepath.IsAbs(directory) {
+		return nil, errors.Errorf("backup directory [%s] must be an absolute path", directory)
+	}
+	fi, err := os.Stat(directory)
+	if err != nil {
+		return nil, errors.Wrapf(err, "backup directory [%s] not found", directory)
+	}
+	if !fi.IsDir() {
+		return nil, errors.Errorf("backup directory [%s] is not a directory", directory)
+	}
+	return &Filesystem{root: directory}, nil
+}
+
+func (f *Filesystem) path(key string) string {
+	return filepath.Join(f.root, filepath.FromSlash(key))
+}
+
+// Put writes body to a temporary file and renames it into place once it is synced to disk
+func (f *Filesystem) Put(key string, body io.Reader, opts PutOptions) error {
+	filename := f.path(key)
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), tempFilePrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// Get opens the file at key for reading
+func (f *Filesystem) Get(key string) (io.ReadCloser, error) {
+	file, err := os.Open(f.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotExist
+	}
+	return file, err
+}
+
+// Head returns the size and modification time of the file at key
+func (f *Filesystem) Head(key string) (*ObjectInfo, error) {
+	fi, err := os.Stat(f.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, ErrNotExist
+	}
+	return &ObjectInfo{Key: key, Size: fi.Size(), LastModified: fi.ModTime()}, nil
+}
+
+// List walks the directory holding prefix and returns the matching files, a "/" delimited
+// listing only reads the directory holding prefix
+func (f *Filesystem) List(prefix string, delimiter string) (*Listing, error) {
+	if delimiter == "/" {
+		return dirListing(prefix, func(dir string) ([]os.FileInfo, error) { return ioutil.ReadDir(f.path(dir)) })
+	}
+
+	var (
+		listing  = &Listing{}
+		prefixes = make(map[string]bool)
+	)
+
+	// start walking from the deepest directory that fully contains the prefix
+	dir := f.root
+	if idx := strings.LastIndex(prefix, "/"); idx >= 0 {
+		dir = f.path(prefix[:idx])
+	}
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), tempFilePrefix) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(f.root, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		if delimiter != "" {
+			rest := strings.TrimPrefix(key, prefix)
+			if idx := strings.Index(rest, delimiter); idx >= 0 {
+				prefixes[prefix+rest[:idx+len(delimiter)]] = true
+				return nil
+			}
+		}
+		listing.Objects = append(listing.Objects, ObjectInfo{Key: key, Size: info.Size(), LastModified: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list files")
+	}
+
+	for p := range prefixes {
+		listing.Prefixes = append(listing.Prefixes, p)
+	}
+	sort.Strings(listing.Prefixes)
+	return listing, nil
+}
+
+// Delete removes the file at key and any directories left empty by it
+func (f *Filesystem) Delete(key string) error {
+	filename := f.path(key)
+	if err := os.Remove(filename); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for dir := filepath.Dir(filename); dir != f.root && strings.HasPrefix(dir, f.root); dir = filepath.Dir(dir) {
+		// os.Remove refuses to delete directories that still have entries
+		if err := os.Remove(dir); err != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// dirListing lists the directory holding prefix like a "/" delimited listing of an object store,
+// subdirectories are returned as prefixes without reading them. readDir reads the directory at a key.
+func dirListing(prefix string, readDir func(dir string) ([]os.FileInfo, error)) (*Listing, error) {
+	var dir string
+	if idx := strings.LastIndex(prefix, "/"); idx >= 0 {
+		dir = prefix[:idx+1]
+	}
+	entries, err := readDir(dir)
+	if os.IsNotExist(err) {
+		return &Listing{}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list files")
+	}
+
+	listing := &Listing{}
+	for _, info := range entries {
+		key := dir + info.Name()
+		if !strings.HasPrefix(key, prefix) || strings.HasPrefix(info.Name(), tempFilePrefix) {
+			continue
+		}
+		if info.IsDir() {
+			listing.Prefixes = append(listing.Prefixes, key+"/")
+			continue
+		}
+		listing.Objects = append(listing.Objects, ObjectInfo{Key: key, Size: info.Size(), LastModified: info.ModTime()})
+	}
+	sort.Strings(listing.Prefixes)
+	return listing, nil
+}
@@ -0,0 +1,160 @@
+package snappy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFilesystemList(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := NewFilesystem(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{
+		"backups/s1/SNAPSHOT_COMPLETED",
+		"backups/s1/10.0.0.1/manifest.json",
+		"backups/s1/10.0.0.1/ks1/t1-aaa/mc-1-big-Data.db",
+		"backups/s1/10.0.0.2/manifest.json",
+		"backups/s2/10.0.0.1/manifest.json",
+		"backups/s10/10.0.0.1/manifest.json",
+		"shared/ab/abcdef",
+	} {
+		if err := fs.Put(key, strings.NewReader(key), PutOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// an upload that is still being written is not listed
+	if err := ioutil.WriteFile(filepath.Join(dir, "backups", "s1", tempFilePrefix+"123"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "backups", "s1", tempFilePrefix+"dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		prefix    string
+		delimiter string
+		objects   []string
+		prefixes  []string
+	}{
+		{
+			name:   "every object",
+			prefix: "",
+			objects: []string{
+				"backups/s1/10.0.0.1/ks1/t1-aaa/mc-1-big-Data.db",
+				"backups/s1/10.0.0.1/manifest.json",
+				"backups/s1/10.0.0.2/manifest.json",
+				"backups/s1/SNAPSHOT_COMPLETED",
+				"backups/s10/10.0.0.1/manifest.json",
+				"backups/s2/10.0.0.1/manifest.json",
+				"shared/ab/abcdef",
+			},
+		},
+		{
+			name:   "objects under a prefix",
+			prefix: "backups/s1/",
+			objects: []string{
+				"backups/s1/10.0.0.1/ks1/t1-aaa/mc-1-big-Data.db",
+				"backups/s1/10.0.0.1/manifest.json",
+				"backups/s1/10.0.0.2/manifest.json",
+				"backups/s1/SNAPSHOT_COMPLETED",
+			},
+		},
+		{
+			name:   "prefix ending in part of a name",
+			prefix: "backups/s1",
+			objects: []string{
+				"backups/s1/10.0.0.1/ks1/t1-aaa/mc-1-big-Data.db",
+				"backups/s1/10.0.0.1/manifest.json",
+				"backups/s1/10.0.0.2/manifest.json",
+				"backups/s1/SNAPSHOT_COMPLETED",
+				"backups/s10/10.0.0.1/manifest.json",
+			},
+		},
+		{
+			name:      "snapshots",
+			prefix:    "backups/",
+			delimiter: "/",
+			prefixes:  []string{"backups/s1/", "backups/s10/", "backups/s2/"},
+		},
+		{
+			name:      "nodes and markers of a snapshot",
+			prefix:    "backups/s1/",
+			delimiter: "/",
+			objects:   []string{"backups/s1/SNAPSHOT_COMPLETED"},
+			prefixes:  []string{"backups/s1/10.0.0.1/", "backups/s1/10.0.0.2/"},
+		},
+		{
+			name:      "delimited prefix ending in part of a name",
+			prefix:    "backups/s1",
+			delimiter: "/",
+			prefixes:  []string{"backups/s1/", "backups/s10/"},
+		},
+		{
+			name:      "top level",
+			prefix:    "",
+			delimiter: "/",
+			prefixes:  []string{"backups/", "shared/"},
+		},
+		{
+			name:   "missing prefix",
+			prefix: "commitlogs/10.0.0.1/",
+		},
+		{
+			name:      "missing delimited prefix",
+			prefix:    "commitlogs/10.0.0.1/",
+			delimiter: "/",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listing, err := fs.List(tt.prefix, tt.delimiter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var objects []string
+			for _, obj := range listing.Objects {
+				objects = append(objects, obj.Key)
+				if obj.Size != int64(len(obj.Key)) || obj.LastModified.IsZero() {
+					t.Errorf("%s has size %d and modification time %s", obj.Key, obj.Size, obj.LastModified)
+				}
+			}
+			if !reflect.DeepEqual(objects, tt.objects) {
+				t.Errorf("objects are %v, expected %v", objects, tt.objects)
+			}
+			if !reflect.DeepEqual(listing.Prefixes, tt.prefixes) {
+				t.Errorf("prefixes are %v, expected %v", listing.Prefixes, tt.prefixes)
+			}
+		})
+	}
+}
+
+func TestFilesystemDelete(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := NewFilesystem(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := "backups/s1/10.0.0.1/ks1/t1-aaa/mc-1-big-Data.db"
+	if err := fs.Put(key, strings.NewReader("data"), PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Head(key); err != ErrNotExist {
+		t.Errorf("deleted file is still found: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "backups")); !os.IsNotExist(err) {
+		t.Errorf("empty directories were left behind: %v", err)
+	}
+	if err := fs.Delete(key); err != nil {
+		t.Errorf("deleting a missing file failed: %v", err)
+	}
+}
@@ -0,0 +1,433 @@
+package snappy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	gcsDefaultEndpoint = "https://storage.googleapis.com"
+	gcsScope           = "https://www.googleapis.com/auth/devstorage.read_write"
+	// resumable upload chunks must be a multiple of 256KB
+	gcsChunkSize   = 64 * 256 * 1024 // 16MB
+	gcsMaxAttempts = 5
+)
+
+// GCS stores backups in a Google Cloud Storage bucket using the JSON api
+type GCS struct {
+	bucket   string
+	prefix   string
+	endpoint string
+	client   *http.Client
+}
+
+// GCSConfig holds the settings needed to reach Google Cloud Storage
+type GCSConfig struct {
+	Bucket string
+	Prefix string
+	// CredentialsFile is a service account key, application default credentials are used when empty
+	CredentialsFile string
+	// Endpoint overrides the storage api, e.g. http://localhost:4443 for fake-gcs-server.
+	// STORAGE_EMULATOR_HOST is honoured as well. Requests to an emulator are not authenticated.
+	Endpoint string
+}
+
+// gcsObject is the subset of the object resource used by snappy
+type gcsObject struct {
+	Name     string            `json:"name"`
+	Size     string            `json:"size"`
+	Updated  time.Time         `json:"updated"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+type gcsObjectList struct {
+	Items         []gcsObject `json:"items"`
+	Prefixes      []string    `json:"prefixes"`
+	NextPageToken string      `json:"nextPageToken"`
+}
+
+func NewGCS(config *GCSConfig) (*GCS, error) {
+	var (
+		endpoint = config.Endpoint
+		client   *http.Client
+		err      error
+	)
+
+	if endpoint == "" {
+		if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+			endpoint = host
+			if !strings.Contains(endpoint, "://") {
+				endpoint = "http://" + endpoint
+			}
+		}
+	}
+
+	switch {
+	case config.CredentialsFile != "":
+		data, err := ioutil.ReadFile(config.CredentialsFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read credentials [%s]", config.CredentialsFile)
+		}
+		creds, err := google.CredentialsFromJSON(context.Background(), data, gcsScope)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid credentials [%s]", config.CredentialsFile)
+		}
+		client = oauth2.NewClient(context.Background(), creds.TokenSource)
+	case endpoint != "":
+		client = &http.Client{}
+	default:
+		client, err = google.DefaultClient(context.Background(), gcsScope)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to find google application default credentials")
+		}
+	}
+
+	if endpoint == "" {
+		endpoint = gcsDefaultEndpoint
+	}
+
+	g := &GCS{
+		bucket:   config.Bucket,
+		prefix:   config.Prefix,
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		client:   client,
+	}
+
+	resp, err := g.client.Get(g.endpoint + "/storage/v1/b/" + url.PathEscape(g.bucket))
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to reach bucket [%s]", g.bucket)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Info(gcsError(resp))
+		return nil, errors.Errorf("bucket [%s] not found or you do not have sufficient permissions", g.bucket)
+	}
+
+	return g, nil
+}
+
+func (g *GCS) objectURL(key string) string {
+	return g.endpoint + "/storage/v1/b/" + url.PathEscape(g.bucket) + "/o/" + url.PathEscape(joinKey(g.prefix, key))
+}
+
+// Put uploads body with a resumable upload session, sending it in chunks
+// and resuming from the last persisted byte when a chunk fails
+func (g *GCS) Put(key string, body io.Reader, opts PutOptions) error {
+	session, err := g.startUpload(key, opts)
+	if err != nil {
+		return err
+	}
+
+	var (
+		buf    = make([]byte, gcsChunkSize)
+		offset int64
+	)
+	for {
+		n, err := io.ReadFull(body, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := n < len(buf)
+
+		if err := g.uploadChunk(session, buf[:n], offset, last); err != nil {
+			return errors.Wrapf(err, "error uploading %s", key)
+		}
+		offset += int64(n)
+
+		if last {
+			return nil
+		}
+	}
+}
+
+// startUpload creates a resumable upload session and returns its url
+func (g *GCS) startUpload(key string, opts PutOptions) (string, error) {
+	resource := map[string]interface{}{"name": joinKey(g.prefix, key)}
+	if len(opts.Metadata) > 0 {
+		resource["metadata"] = opts.Metadata
+	}
+	if opts.StorageClass != "" {
+		resource["storageClass"] = opts.StorageClass
+	}
+	metadata, err := json.Marshal(resource)
+	if err != nil {
+		return "", err
+	}
+
+	u := g.endpoint + "/upload/storage/v1/b/" + url.PathEscape(g.bucket) + "/o?uploadType=resumable"
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(metadata))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", gcsError(resp)
+	}
+	session := resp.Header.Get("Location")
+	if session == "" {
+		return "", errors.New("no resumable upload session returned")
+	}
+	return session, nil
+}
+
+// uploadChunk sends chunk starting at offset, retrying from whatever part of it the server already persisted
+func (g *GCS) uploadChunk(session string, chunk []byte, offset int64, last bool) error {
+	var sent int64
+
+	for attempt := 1; ; attempt++ {
+		err := g.putRange(session, chunk[sent:], offset+sent, last)
+		if err == nil {
+			return nil
+		}
+		if attempt == gcsMaxAttempts {
+			return err
+		}
+
+		log.Debugf("resumable upload chunk failed, retrying: %v", err)
+		time.Sleep(time.Duration(attempt) * time.Second)
+
+		persisted, complete, err := g.uploadStatus(session)
+		if err != nil {
+			continue
+		}
+		if complete {
+			return nil
+		}
+		if persisted < offset {
+			return errors.Errorf("upload session lost data, persisted %d bytes but expected at least %d", persisted, offset)
+		}
+		if persisted > offset+int64(len(chunk)) {
+			persisted = offset + int64(len(chunk))
+		}
+		sent = persisted - offset
+	}
+}
+
+// putRange sends data to the session, a final range also carries the total object size
+func (g *GCS) putRange(session string, data []byte, offset int64, last bool) error {
+	var contentRange string
+
+	end := offset + int64(len(data)) - 1
+	switch {
+	case last && len(data) == 0:
+		contentRange = fmt.Sprintf("bytes */%d", offset)
+	case last:
+		contentRange = fmt.Sprintf("bytes %d-%d/%d", offset, end, end+1)
+	default:
+		contentRange = fmt.Sprintf("bytes %d-%d/*", offset, end)
+	}
+
+	req, err := http.NewRequest(http.MethodPut, session, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Range", contentRange)
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated:
+		return nil
+	case resp.StatusCode == http.StatusPermanentRedirect && !last:
+		// 308 means more data is expected, the server may have persisted only part of the chunk
+		if r := resp.Header.Get("Range"); r != "" && r != fmt.Sprintf("bytes=0-%d", end) {
+			return errors.Errorf("partial chunk persisted [%s]", r)
+		}
+		return nil
+	default:
+		return gcsError(resp)
+	}
+}
+
+// uploadStatus asks the server how many bytes of the upload have been persisted
+// and whether the upload was already finalized
+func (g *GCS) uploadStatus(session string) (int64, bool, error) {
+	req, err := http.NewRequest(http.MethodPut, session, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	req.Header.Set("Content-Range", "bytes */*")
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return 0, true, nil
+	case http.StatusPermanentRedirect:
+	default:
+		return 0, false, gcsError(resp)
+	}
+
+	// Range is formatted as bytes=0-N and is missing when nothing was persisted yet
+	r := resp.Header.Get("Range")
+	if r == "" {
+		return 0, false, nil
+	}
+	_, last := Split(strings.TrimPrefix(r, "bytes="), "-")
+	n, err := strconv.ParseInt(last, 10, 64)
+	if err != nil {
+		return 0, false, errors.Wrapf(err, "invalid range [%s]", r)
+	}
+	return n + 1, false, nil
+}
+
+// Get downloads the object media
+func (g *GCS) Get(key string) (io.ReadCloser, error) {
+	resp, err := g.client.Get(g.objectURL(key) + "?alt=media")
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, gcsError(resp)
+	}
+	return resp.Body, nil
+}
+
+// Head fetches the object metadata
+func (g *GCS) Head(key string) (*ObjectInfo, error) {
+	resp, err := g.client.Get(g.objectURL(key))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, gcsError(resp)
+	}
+
+	var obj gcsObject
+	if err := json.NewDecoder(resp.Body).Decode(&obj); err != nil {
+		return nil, err
+	}
+	info := g.objectInfo(obj)
+	return &info, nil
+}
+
+// List pages through the objects under prefix
+func (g *GCS) List(prefix string, delimiter string) (*Listing, error) {
+	var (
+		listing   = &Listing{}
+		pageToken string
+	)
+
+	for {
+		params := url.Values{}
+		params.Set("prefix", joinKey(g.prefix, prefix))
+		params.Set("fields", "items(name,size,updated,metadata),prefixes,nextPageToken")
+		if delimiter != "" {
+			params.Set("delimiter", delimiter)
+		}
+		if pageToken != "" {
+			params.Set("pageToken", pageToken)
+		}
+
+		page, err := g.listPage(params)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to list objects")
+		}
+
+		for _, p := range page.Prefixes {
+			listing.Prefixes = append(listing.Prefixes, trimKey(g.prefix, p))
+		}
+		for _, obj := range page.Items {
+			listing.Objects = append(listing.Objects, g.objectInfo(obj))
+		}
+
+		if page.NextPageToken == "" {
+			return listing, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+func (g *GCS) listPage(params url.Values) (*gcsObjectList, error) {
+	u := g.endpoint + "/storage/v1/b/" + url.PathEscape(g.bucket) + "/o?" + params.Encode()
+	resp, err := g.client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, gcsError(resp)
+	}
+
+	var page gcsObjectList
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// Delete removes the object, deleting a missing object is not an error
+func (g *GCS) Delete(key string) error {
+	req, err := http.NewRequest(http.MethodDelete, g.objectURL(key), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	return gcsError(resp)
+}
+
+func (g *GCS) objectInfo(obj gcsObject) ObjectInfo {
+	size, _ := strconv.ParseInt(obj.Size, 10, 64)
+	return ObjectInfo{Key: trimKey(g.prefix, obj.Name), Size: size, LastModified: obj.Updated, Metadata: obj.Metadata}
+}
+
+// gcsError turns an unexpected response into an error, mapping 404 to ErrNotExist
+func gcsError(resp *http.Response) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotExist
+	}
+
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err := json.Unmarshal(data, &body); err == nil && body.Error.Message != "" {
+		return errors.Errorf("gcs: %s: %s", resp.Status, body.Error.Message)
+	}
+	return errors.Errorf("gcs: %s", resp.Status)
+}
@@ -0,0 +1,250 @@
+package snappy
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// ChainFilename is written next to the manifest of a snapshot that incremental backups were taken on
+const ChainFilename = "chain.json"
+
+// Chain lists, in order, the incremental backups a node uploaded on top of a base snapshot
+type Chain struct {
+	Base         string   `json:"base"`
+	Incrementals []string `json:"incrementals"`
+}
+
+// BackupIncremental uploads the sstables Cassandra hardlinked into the backups directory of
+// every table since the base snapshot or the previous incremental backup. Files are removed
+// from the backups directories once every destination received them.
+func BackupIncremental(configs []*StorageConfig, snapshotID, baseID string, options *BackupOptions) error {
+	if snapshotID == baseID {
+		return errors.New("an incremental backup needs its own snapshot id")
+	}
+
+	fanout, err := openFanout(configs)
+	if err != nil {
+		return err
+	}
+	cassandra := NewCassandra()
+	if !cassandra.IncrementalBackupsEnabled() {
+		log.Warn("incremental_backups is not enabled in cassandra.yaml, only sstables already in the backups directories will be uploaded")
+	}
+
+	nodeIP := cassandra.GetListenAddress()
+	for _, remote := range fanout.remotes {
+		if !remote.IsSnapshotComplete(filepath.Join(SnapshotFolderPrefix, baseID, nodeIP)) {
+			return errors.Errorf("base snapshot [%s] is not complete for node [%s] on [%s]", baseID, nodeIP, remote)
+		}
+	}
+
+	// sstables are immutable, a file already in the base snapshot or an earlier incremental is the same file.
+	// A destination may have missed an earlier incremental, a file is only skipped when every destination has it.
+	shipped, err := fanout.remotes[0].ChainFiles(baseID, nodeIP)
+	if err != nil {
+		return err
+	}
+	for _, remote := range fanout.remotes[1:] {
+		files, err := remote.ChainFiles(baseID, nodeIP)
+		if err != nil {
+			return err
+		}
+		for path := range shipped {
+			if !files[path] {
+				delete(shipped, path)
+			}
+		}
+	}
+
+	dataDirs := cassandra.GetDataDirectories()
+	files, err := cassandra.GetIncrementalFiles(snapshotID, nodeIP, SnapshotFolderPrefix, dataDirs)
+	if err != nil {
+		return err
+	}
+
+	var (
+		pending   = make(map[string]string)
+		removable []string
+	)
+	for path, key := range files {
+		file := newManifestFile(key, 0)
+		if len(options.Keyspaces) > 0 && !contains(options.Keyspaces, file.Keyspace) {
+			continue
+		}
+		removable = append(removable, path)
+		if !shipped[file.Path()] {
+			pending[path] = key
+		}
+	}
+	log.Infof("uploading %d new sstable files on top of snapshot [%s], %d were already backed up", len(pending), baseID, len(removable)-len(pending))
+
+	manifest := NewManifest(cassandra, nodeIP, snapshotID)
+	manifest.Base = baseID
+	manifest.Labels = options.Labels
+	totalSize, err := uploadFiles(fanout, manifest, pending, options)
+	if err != nil {
+		return err
+	}
+
+	// tables created since the base snapshot are only described by the latest schema
+	if schema := captureSchema(cassandra); schema != nil {
+		fanout.WriteSchema(snapshotID, nodeIP, schema, options.Keyring)
+	}
+	fanout.WriteManifest(manifest)
+	fanout.MarkSnapshotComplete(filepath.Join(SnapshotFolderPrefix, snapshotID), nodeIP)
+	fanout.AppendChain(baseID, nodeIP, snapshotID)
+
+	// keep the hardlinks when a destination is missing files, the next run uploads them again
+	if err := fanout.Err(); err != nil {
+		return err
+	}
+	for _, path := range removable {
+		if err := os.Remove(path); err != nil {
+			log.Warnf("unable to remove backed up file %s: %v", path, err)
+		}
+	}
+
+	log.Infoln("uploaded a total size of:", humanize.Bytes(uint64(totalSize)))
+	return nil
+}
+
+// chainKey returns the key of the chain of incremental backups of a node snapshot
+func chainKey(baseID, node string) string {
+	return filepath.Join(SnapshotFolderPrefix, baseID, node, ChainFilename)
+}
+
+// ReadChain downloads the chain of incremental backups of a node snapshot,
+// a snapshot without incremental backups has an empty chain
+func (r *Remote) ReadChain(baseID, node string) (*Chain, error) {
+	body, err := r.storage.Get(chainKey(baseID, node))
+	if err == ErrNotExist {
+		return &Chain{Base: baseID}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	chain := &Chain{}
+	if err := json.NewDecoder(body).Decode(chain); err != nil {
+		return nil, errors.Wrapf(err, "invalid incremental chain for node [%s]", node)
+	}
+	return chain, nil
+}
+
+// AppendChain records an incremental backup at the end of the chain of its base snapshot
+func (r *Remote) AppendChain(baseID, node, snapshotID string) error {
+	chain, err := r.ReadChain(baseID, node)
+	if err != nil {
+		return err
+	}
+	if contains(chain.Incrementals, snapshotID) {
+		return nil
+	}
+	chain.Incrementals = append(chain.Incrementals, snapshotID)
+	return r.writeChain(node, chain)
+}
+
+// writeChain uploads the chain of incremental backups of a node snapshot
+func (r *Remote) writeChain(node string, chain *Chain) error {
+	data, err := json.MarshalIndent(chain, "", "\t")
+	if err != nil {
+		return err
+	}
+	key := chainKey(chain.Base, node)
+	if err := r.storage.Put(key, bytes.NewReader(data), PutOptions{}); err != nil {
+		return errors.Wrapf(err, "error uploading %s", key)
+	}
+	return nil
+}
+
+// LoadChain returns the manifests needed to restore snapshotID on a node: the snapshot itself,
+// or for an incremental backup its base snapshot followed by every incremental up to snapshotID
+func (r *Remote) LoadChain(snapshotID, node string) ([]*Manifest, error) {
+	manifest, err := r.LoadManifest(snapshotID, node)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.Base == "" {
+		return []*Manifest{manifest}, nil
+	}
+
+	base, err := r.LoadManifest(manifest.Base, node)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := r.ReadChain(manifest.Base, node)
+	if err != nil {
+		return nil, err
+	}
+
+	manifests := []*Manifest{base}
+	for _, id := range chain.Incrementals {
+		if id == snapshotID {
+			return append(manifests, manifest), nil
+		}
+		incremental, err := r.ReadManifest(id, node)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read incremental backup [%s]", id)
+		}
+		manifests = append(manifests, incremental)
+	}
+	return nil, errors.Errorf("incremental backup [%s] is missing from the chain of snapshot [%s]", snapshotID, manifest.Base)
+}
+
+// ChainFiles returns the path of every file in a node snapshot and its incremental backups
+func (r *Remote) ChainFiles(baseID, node string) (map[string]bool, error) {
+	files := make(map[string]bool)
+
+	base, err := r.LoadManifest(baseID, node)
+	if err != nil {
+		return nil, err
+	}
+	manifests := []*Manifest{base}
+
+	chain, err := r.ReadChain(baseID, node)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range chain.Incrementals {
+		incremental, err := r.ReadManifest(id, node)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read incremental backup [%s]", id)
+		}
+		manifests = append(manifests, incremental)
+	}
+
+	for _, m := range manifests {
+		for _, file := range m.Files {
+			files[file.Path()] = true
+		}
+	}
+	return files, nil
+}
+
+// mergeManifests combines a snapshot and its incremental backups into a single list of files,
+// the most recent copy of a file wins
+func mergeManifests(manifests []*Manifest) *Manifest {
+	var (
+		merged = *manifests[len(manifests)-1]
+		index  = make(map[string]int)
+	)
+	merged.Files = nil
+	for _, m := range manifests {
+		for _, file := range m.Files {
+			if i, ok := index[file.Path()]; ok {
+				merged.Files[i] = file
+				continue
+			}
+			index[file.Path()] = len(merged.Files)
+			merged.Files = append(merged.Files, file)
+		}
+	}
+	return &merged
+}
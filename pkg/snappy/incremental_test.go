@@ -0,0 +1,135 @@
+package snappy
+
+import (
+	"reflect"
+	"testing"
+)
+
+// testRemote returns a remote storing objects in a temporary directory
+func testRemote(t *testing.T) *Remote {
+	t.Helper()
+	dir := t.TempDir()
+	fs, err := NewFilesystem(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewRemote("file://"+dir, fs)
+}
+
+// testManifest describes a node snapshot holding files of ks1.t1, given by file name
+func testManifest(snapshotID, base string, names ...string) *Manifest {
+	manifest := &Manifest{SnapshotID: snapshotID, Base: base, Node: ManifestNode{Address: "10.0.0.1"}}
+	for _, name := range names {
+		manifest.Files = append(manifest.Files, newManifestFile(
+			"backups/"+snapshotID+"/10.0.0.1/ks1/t1-aaa/"+name, int64(len(name))))
+	}
+	return manifest
+}
+
+// paths returns the path of every file of a manifest
+func paths(manifest *Manifest) []string {
+	var paths []string
+	for _, file := range manifest.Files {
+		paths = append(paths, file.Path())
+	}
+	return paths
+}
+
+func TestMergeManifests(t *testing.T) {
+	tests := []struct {
+		name      string
+		manifests []*Manifest
+		want      []string
+		wantKeys  map[string]string
+	}{
+		{
+			name:      "snapshot only",
+			manifests: []*Manifest{testManifest("b1", "", "mc-1-big-Data.db", "mc-1-big-Index.db")},
+			want:      []string{"ks1/t1-aaa/mc-1-big-Data.db", "ks1/t1-aaa/mc-1-big-Index.db"},
+		},
+		{
+			name: "incrementals add files in order",
+			manifests: []*Manifest{
+				testManifest("b1", "", "mc-1-big-Data.db"),
+				testManifest("i1", "b1", "mc-2-big-Data.db"),
+				testManifest("i2", "b1", "mc-3-big-Data.db"),
+			},
+			want: []string{"ks1/t1-aaa/mc-1-big-Data.db", "ks1/t1-aaa/mc-2-big-Data.db", "ks1/t1-aaa/mc-3-big-Data.db"},
+		},
+		{
+			name: "the most recent copy of a file wins",
+			manifests: []*Manifest{
+				testManifest("b1", "", "mc-1-big-Data.db", "schema.cql"),
+				testManifest("i1", "b1", "schema.cql"),
+			},
+			want:     []string{"ks1/t1-aaa/mc-1-big-Data.db", "ks1/t1-aaa/schema.cql"},
+			wantKeys: map[string]string{"ks1/t1-aaa/schema.cql": "backups/i1/10.0.0.1/ks1/t1-aaa/schema.cql"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merged := mergeManifests(tt.manifests)
+			if got := paths(merged); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("merged files are %v, expected %v", got, tt.want)
+			}
+			if last := tt.manifests[len(tt.manifests)-1]; merged.SnapshotID != last.SnapshotID {
+				t.Errorf("merged snapshot is %s, expected %s", merged.SnapshotID, last.SnapshotID)
+			}
+			for _, file := range merged.Files {
+				if key, ok := tt.wantKeys[file.Path()]; ok && file.Key != key {
+					t.Errorf("%s is read from %s, expected %s", file.Path(), file.Key, key)
+				}
+			}
+		})
+	}
+}
+
+func TestChainFiles(t *testing.T) {
+	remote := testRemote(t)
+	for _, manifest := range []*Manifest{
+		testManifest("b1", "", "mc-1-big-Data.db", "mc-1-big-Index.db"),
+		testManifest("i1", "b1", "mc-2-big-Data.db"),
+		testManifest("i2", "b1", "mc-3-big-Data.db"),
+	} {
+		if err := remote.WriteManifest(manifest); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		chain []string
+		want  []string
+	}{
+		{"base snapshot without incrementals", nil, []string{"mc-1-big-Data.db", "mc-1-big-Index.db"}},
+		{"incrementals recorded in the chain", []string{"i1"}, []string{"mc-1-big-Data.db", "mc-1-big-Index.db", "mc-2-big-Data.db"}},
+		{"every incremental", []string{"i1", "i2"}, []string{"mc-1-big-Data.db", "mc-1-big-Index.db", "mc-2-big-Data.db", "mc-3-big-Data.db"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.chain != nil {
+				if err := remote.writeChain("10.0.0.1", &Chain{Base: "b1", Incrementals: tt.chain}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			files, err := remote.ChainFiles("b1", "10.0.0.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := make(map[string]bool)
+			for _, name := range tt.want {
+				want["ks1/t1-aaa/"+name] = true
+			}
+			if !reflect.DeepEqual(files, want) {
+				t.Errorf("chain files are %v, expected %v", files, want)
+			}
+		})
+	}
+
+	if err := remote.writeChain("10.0.0.1", &Chain{Base: "b1", Incrementals: []string{"i1", "missing"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remote.ChainFiles("b1", "10.0.0.1"); err == nil {
+		t.Error("a chain with a missing incremental backup was read without an error")
+	}
+}
@@ -0,0 +1,274 @@
+package snappy
+
+import (
+	"math/big"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// tocComponent lists the components of an SSTable, one per line
+const tocComponent = "TOC.txt"
+
+// SnapshotReport describes what a snapshot contains on every node
+type SnapshotReport struct {
+	SnapshotID string `json:"snapshot_id"`
+	Base       string `json:"base,omitempty"`
+	Cluster    string `json:"cluster,omitempty"`
+	// Complete reports whether the cluster completion marker was written
+	Complete bool         `json:"complete"`
+	Nodes    []NodeReport `json:"nodes"`
+}
+
+// NodeReport describes the snapshot of a node
+type NodeReport struct {
+	Address          string `json:"address"`
+	HostID           string `json:"host_id,omitempty"`
+	Datacenter       string `json:"datacenter,omitempty"`
+	Rack             string `json:"rack,omitempty"`
+	CassandraVersion string `json:"cassandra_version,omitempty"`
+	SnappyVersion    string `json:"snappy_version,omitempty"`
+	// Complete reports whether the node wrote its completion marker
+	Complete    bool             `json:"complete"`
+	Files       int              `json:"files"`
+	Size        int64            `json:"size"`
+	SSTables    int              `json:"sstables"`
+	TokenRanges []TokenRange     `json:"token_ranges,omitempty"`
+	Keyspaces   []KeyspaceReport `json:"keyspaces"`
+}
+
+// KeyspaceReport describes the tables of a keyspace in a node snapshot
+type KeyspaceReport struct {
+	Name     string        `json:"name"`
+	Files    int           `json:"files"`
+	Size     int64         `json:"size"`
+	SSTables int           `json:"sstables"`
+	Tables   []TableReport `json:"tables"`
+}
+
+// TableReport describes the files of a table in a node snapshot
+type TableReport struct {
+	Name     string `json:"name"`
+	UUID     string `json:"uuid"`
+	Files    int    `json:"files"`
+	Size     int64  `json:"size"`
+	SSTables int    `json:"sstables"`
+	// Checksums holds the sha256 of every file by name, when the manifest or the object metadata recorded it
+	Checksums map[string]string `json:"checksums,omitempty"`
+	// Incomplete lists the SSTables that are missing components
+	Incomplete []IncompleteSSTable `json:"incomplete,omitempty"`
+}
+
+// IncompleteSSTable is an SSTable that cannot be loaded because components are missing
+type IncompleteSSTable struct {
+	Name    string   `json:"name"`
+	Missing []string `json:"missing"`
+}
+
+// TokenRange is a range of the ring a node owns, from Start exclusive to End inclusive
+type TokenRange struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// Inspect reports the nodes, keyspaces, tables and SSTables of a snapshot from its manifests.
+// The keyring is only needed to read the TOC.txt of encrypted SSTables, without it the
+// components every SSTable needs are checked.
+func Inspect(config *StorageConfig, snapshotID string, keyring *Keyring) (*SnapshotReport, error) {
+	remote, err := OpenRemote(config)
+	if err != nil {
+		return nil, err
+	}
+	nodes := remote.ListNodes(snapshotID)
+	if len(nodes) == 0 {
+		return nil, errors.Errorf("snapshot [%s] does not exist on [%s]", snapshotID, remote)
+	}
+
+	report := &SnapshotReport{SnapshotID: snapshotID, Complete: remote.IsClusterSnapshotComplete(snapshotID)}
+	tokens := make(map[string][]string)
+	for _, node := range nodes {
+		manifest, err := remote.LoadManifest(snapshotID, node)
+		if err != nil {
+			return nil, err
+		}
+		if manifest.CreatedAt.IsZero() {
+			remote.describeFromMetadata(manifest, true)
+		}
+		if manifest.Cluster != "" {
+			report.Cluster, report.Base = manifest.Cluster, manifest.Base
+		}
+		tokens[node] = manifest.Node.Tokens
+
+		nodeReport := NodeReport{
+			Address:          node,
+			HostID:           manifest.Node.HostID,
+			Datacenter:       manifest.Node.Datacenter,
+			Rack:             manifest.Node.Rack,
+			CassandraVersion: manifest.Node.CassandraVersion,
+			SnappyVersion:    manifest.Version,
+			Complete:         remote.IsSnapshotComplete(filepath.Join(SnapshotFolderPrefix, snapshotID, node)),
+		}
+		tables := manifest.Tables()
+		keyspaces := make(map[string]bool)
+		for keyspace := range tables {
+			keyspaces[keyspace] = true
+		}
+
+		for _, keyspace := range sortedSet(keyspaces) {
+			ks := KeyspaceReport{Name: keyspace}
+			for _, table := range tables[keyspace] {
+				name, uuid := Split(table, "-")
+				t := remote.inspectTable(manifest.TableFiles(keyspace, name, uuid), keyring)
+				t.Name, t.UUID = name, uuid
+				ks.Files += t.Files
+				ks.Size += t.Size
+				ks.SSTables += t.SSTables
+				ks.Tables = append(ks.Tables, t)
+			}
+			nodeReport.Files += ks.Files
+			nodeReport.Size += ks.Size
+			nodeReport.SSTables += ks.SSTables
+			nodeReport.Keyspaces = append(nodeReport.Keyspaces, ks)
+		}
+		report.Nodes = append(report.Nodes, nodeReport)
+	}
+
+	// incremental backups are only marked complete per node
+	if report.Base != "" {
+		report.Complete = true
+		for _, node := range report.Nodes {
+			report.Complete = report.Complete && node.Complete
+		}
+	}
+
+	ranges := tokenRanges(tokens)
+	for i := range report.Nodes {
+		report.Nodes[i].TokenRanges = ranges[report.Nodes[i].Address]
+	}
+	return report, nil
+}
+
+// inspectTable counts the files and SSTables of a table and finds the SSTables missing components
+func (r *Remote) inspectTable(files []ManifestFile, keyring *Keyring) TableReport {
+	var (
+		report     TableReport
+		names      []string
+		components = make(map[string]map[string]ManifestFile)
+	)
+	for _, file := range files {
+		report.Files++
+		report.Size += fileSize(file)
+		if file.Checksum != "" {
+			if report.Checksums == nil {
+				report.Checksums = make(map[string]string)
+			}
+			report.Checksums[path.Base(file.Key)] = file.Checksum
+		}
+
+		name, component, ok := sstableComponent(file.Key)
+		if !ok {
+			continue
+		}
+		if components[name] == nil {
+			components[name] = make(map[string]ManifestFile)
+			names = append(names, name)
+		}
+		components[name][component] = file
+	}
+	report.SSTables = len(components)
+
+	sort.Strings(names)
+	for _, name := range names {
+		var missing []string
+		for _, component := range r.requiredComponents(components[name], keyring) {
+			if _, ok := components[name][component]; !ok {
+				missing = append(missing, component)
+			}
+		}
+		if len(missing) > 0 {
+			report.Incomplete = append(report.Incomplete, IncompleteSSTable{Name: name, Missing: missing})
+		}
+	}
+	return report
+}
+
+// requiredComponents returns the components an SSTable needs, those listed in its TOC.txt
+// or, when it cannot be read, the ones every SSTable has
+func (r *Remote) requiredComponents(components map[string]ManifestFile, keyring *Keyring) []string {
+	if toc, ok := components[tocComponent]; ok && (toc.KeyID == "" || keyring != nil) {
+		data, err := r.readFile(toc, keyring)
+		if err == nil {
+			var required []string
+			for _, line := range strings.Split(string(data), "\n") {
+				if line = strings.TrimSpace(line); line != "" {
+					required = append(required, line)
+				}
+			}
+			return required
+		}
+		log.Warnf("unable to read %s: %v", toc.Key, err)
+	}
+
+	required := []string{"Data.db", "Statistics.db", tocComponent}
+	// SSTables in the trie format have a partition index instead of Index.db
+	if _, ok := components["Partitions.db"]; ok {
+		return append(required, "Partitions.db")
+	}
+	return append(required, "Index.db")
+}
+
+// sstableComponent splits the key of an SSTable file into the name of the SSTable and the component,
+// e.g. mc-1-big-Data.db into mc-1-big and Data.db, other files of a table are not SSTable components
+func sstableComponent(key string) (string, string, bool) {
+	base := path.Base(key)
+	idx := strings.LastIndex(base, "-")
+	if idx <= 0 {
+		return "", "", false
+	}
+	return base[:idx], base[idx+1:], true
+}
+
+// fileSize returns the size of a file, or of its object when a manifest was rebuilt from a listing
+func fileSize(file ManifestFile) int64 {
+	if file.Size < 0 {
+		return file.ObjectSize()
+	}
+	return file.Size
+}
+
+// tokenRanges returns the ranges of the ring every node owns, a node owns the range
+// from the token before each of its tokens to that token
+func tokenRanges(tokens map[string][]string) map[string][]TokenRange {
+	type owned struct {
+		token string
+		value *big.Int
+		node  string
+	}
+	var ring []owned
+	numeric := true
+	for node, list := range tokens {
+		for _, token := range list {
+			value, ok := new(big.Int).SetString(token, 10)
+			numeric = numeric && ok
+			ring = append(ring, owned{token, value, node})
+		}
+	}
+	// tokens of the byte ordered partitioner are hex strings
+	sort.Slice(ring, func(i, j int) bool {
+		if numeric {
+			return ring[i].value.Cmp(ring[j].value) < 0
+		}
+		return ring[i].token < ring[j].token
+	})
+
+	ranges := make(map[string][]TokenRange)
+	for i, t := range ring {
+		prev := ring[(i+len(ring)-1)%len(ring)]
+		ranges[t.node] = append(ranges[t.node], TokenRange{Start: prev.token, End: t.token})
+	}
+	return ranges
+}
@@ -0,0 +1,146 @@
+package snappy
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTokenRanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		tokens map[string][]string
+		want   map[string][]TokenRange
+	}{
+		{
+			name:   "single token owns the whole ring",
+			tokens: map[string][]string{"10.0.0.1": {"0"}},
+			want:   map[string][]TokenRange{"10.0.0.1": {{Start: "0", End: "0"}}},
+		},
+		{
+			name: "tokens are ordered numerically and the first range wraps around",
+			tokens: map[string][]string{
+				"10.0.0.1": {"-9000000000000000000", "20"},
+				"10.0.0.2": {"3", "100"},
+			},
+			want: map[string][]TokenRange{
+				"10.0.0.1": {{Start: "100", End: "-9000000000000000000"}, {Start: "3", End: "20"}},
+				"10.0.0.2": {{Start: "-9000000000000000000", End: "3"}, {Start: "20", End: "100"}},
+			},
+		},
+		{
+			name: "random partitioner tokens larger than 64 bits",
+			tokens: map[string][]string{
+				"10.0.0.1": {"85070591730234615865843651857942052864"},
+				"10.0.0.2": {"9"},
+			},
+			want: map[string][]TokenRange{
+				"10.0.0.1": {{Start: "9", End: "85070591730234615865843651857942052864"}},
+				"10.0.0.2": {{Start: "85070591730234615865843651857942052864", End: "9"}},
+			},
+		},
+		{
+			name: "byte ordered tokens are compared as strings",
+			tokens: map[string][]string{
+				"10.0.0.1": {"0a"},
+				"10.0.0.2": {"ff", "1b"},
+			},
+			want: map[string][]TokenRange{
+				"10.0.0.1": {{Start: "ff", End: "0a"}},
+				"10.0.0.2": {{Start: "0a", End: "1b"}, {Start: "1b", End: "ff"}},
+			},
+		},
+		{
+			name:   "no tokens",
+			tokens: map[string][]string{},
+			want:   map[string][]TokenRange{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tokenRanges(tt.tokens); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("token ranges are %v, expected %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequiredComponents(t *testing.T) {
+	remote := testRemote(t)
+	keyring := testKeyring(t, testKey(t))
+	prefix := "backups/s1/10.0.0.1/ks1/t1-aaa/mc-1-big-"
+	toc := "Data.db\nIndex.db\nFilter.db\nTOC.txt\n\n"
+
+	put := func(key string, data string, encoding Encoding) ManifestFile {
+		file := ManifestFile{Key: key, Size: int64(len(data)), Compression: encoding.Compression.Codec, KeyID: encoding.KeyID()}
+		if !encoding.Identity() {
+			file.Object = key + encoding.Extension()
+		}
+		reader, err := encoding.Reader(strings.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reader.Close()
+		if err := remote.storage.Put(file.ObjectKey(), reader, PutOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	plainTOC := put(prefix+"TOC.txt", toc, Encoding{})
+	encryptedTOC := put("backups/s2/10.0.0.1/ks1/t1-aaa/mc-1-big-TOC.txt", toc, Encoding{Keyring: keyring})
+	compressedTOC := put("backups/s3/10.0.0.1/ks1/t1-aaa/mc-1-big-TOC.txt", toc, Encoding{Compression: Compression{Codec: CodecZstd}})
+
+	defaults := []string{"Data.db", "Statistics.db", "TOC.txt", "Index.db"}
+	fromTOC := []string{"Data.db", "Index.db", "Filter.db", "TOC.txt"}
+	tests := []struct {
+		name       string
+		components map[string]ManifestFile
+		keyring    *Keyring
+		want       []string
+	}{
+		{"listed in the TOC", map[string]ManifestFile{"TOC.txt": plainTOC}, nil, fromTOC},
+		{"listed in a compressed TOC", map[string]ManifestFile{"TOC.txt": compressedTOC}, nil, fromTOC},
+		{"listed in an encrypted TOC", map[string]ManifestFile{"TOC.txt": encryptedTOC}, keyring, fromTOC},
+		{"encrypted TOC without a key", map[string]ManifestFile{"TOC.txt": encryptedTOC}, nil, defaults},
+		{"TOC is missing", map[string]ManifestFile{"Data.db": {Key: prefix + "Data.db"}}, nil, defaults},
+		{"TOC cannot be downloaded", map[string]ManifestFile{"TOC.txt": {Key: prefix + "missing-TOC.txt"}}, nil, defaults},
+		{
+			"trie indexed SSTable without a TOC",
+			map[string]ManifestFile{"Partitions.db": {Key: "backups/s1/10.0.0.1/ks1/t1-aaa/da-1-bti-Partitions.db"}},
+			nil,
+			[]string{"Data.db", "Statistics.db", "TOC.txt", "Partitions.db"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := remote.requiredComponents(tt.components, tt.keyring); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("required components are %v, expected %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInspectTable(t *testing.T) {
+	remote := testRemote(t)
+	var files []ManifestFile
+	for _, name := range []string{"mc-1-big-Data.db", "mc-1-big-Index.db", "mc-1-big-Statistics.db", "mc-1-big-TOC.txt", "mc-2-big-Data.db", "schema.cql"} {
+		files = append(files, ManifestFile{Key: "backups/s1/10.0.0.1/ks1/t1-aaa/" + name, Size: 10, Checksum: "c-" + name})
+	}
+	data := "Data.db\nIndex.db\nStatistics.db\nTOC.txt\n"
+	if err := remote.storage.Put(files[3].Key, bytes.NewReader([]byte(data)), PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	report := remote.inspectTable(files, nil)
+	if report.Files != 6 || report.Size != 60 || report.SSTables != 2 {
+		t.Errorf("table has %d files, %d bytes and %d sstables, expected 6, 60 and 2", report.Files, report.Size, report.SSTables)
+	}
+	want := []IncompleteSSTable{{Name: "mc-2-big", Missing: []string{"Statistics.db", "TOC.txt", "Index.db"}}}
+	if !reflect.DeepEqual(report.Incomplete, want) {
+		t.Errorf("incomplete sstables are %v, expected %v", report.Incomplete, want)
+	}
+	if report.Checksums["schema.cql"] != "c-schema.cql" {
+		t.Errorf("checksums are %v", report.Checksums)
+	}
+}
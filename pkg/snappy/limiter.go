@@ -0,0 +1,170 @@
+package snappy
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// limiterChunkSize is the most a limited reader reads at once, it keeps waits short and smooth
+	limiterChunkSize = 32 * 1024
+	// limiterBurst is how long a limiter can sit idle and still pass the saved up bytes at once
+	limiterBurst = 100 * time.Millisecond
+)
+
+var (
+	// DiskLimiter limits the bytes read from and written to local disks by every transfer in the process
+	DiskLimiter = NewLimiter(0)
+	// NetworkLimiter limits the bytes sent to and received from destinations by every transfer in the process
+	NetworkLimiter = NewLimiter(0)
+)
+
+// Limiter is a token bucket shared by concurrent transfers, its rate can be changed while they are running
+type Limiter struct {
+	mu     sync.Mutex
+	rate   int
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a limiter passing rate bytes per second, 0 means unlimited
+func NewLimiter(rate int) *Limiter {
+	return &Limiter{rate: rate, last: time.Now()}
+}
+
+// SetRate changes the limit to rate bytes per second, 0 means unlimited
+func (l *Limiter) SetRate(rate int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = rate
+	l.tokens = 0
+	l.last = time.Now()
+}
+
+// Rate returns the limit in bytes per second, 0 means unlimited
+func (l *Limiter) Rate() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// Wait blocks until n bytes can pass the limiter
+func (l *Limiter) Wait(n int) {
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return
+	}
+
+	now := time.Now()
+	rate := float64(l.rate)
+	l.tokens += now.Sub(l.last).Seconds() * rate
+	if burst := limiterBurst.Seconds() * rate; l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+
+	// callers borrow from the bucket and sleep off the debt, later callers queue behind it
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	time.Sleep(wait)
+}
+
+// Reader limits reads from reader
+func (l *Limiter) Reader(reader io.Reader) io.Reader {
+	return &limitedReader{reader: reader, limiter: l}
+}
+
+// limitedReader waits on a limiter for every chunk it reads
+type limitedReader struct {
+	reader  io.Reader
+	limiter *Limiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > limiterChunkSize {
+		p = p[:limiterChunkSize]
+	}
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.limiter.Wait(n)
+	}
+	return n, err
+}
+
+// Limits are the rates of the process wide limiters in megabits/s, 0 means unlimited
+type Limits struct {
+	Network int `json:"network"`
+	Disk    int `json:"disk"`
+}
+
+// CurrentLimits returns the rates of the process wide limiters
+func CurrentLimits() Limits {
+	return Limits{
+		Network: NetworkLimiter.Rate() / Mbps,
+		Disk:    DiskLimiter.Rate() / Mbps,
+	}
+}
+
+// SetLimits changes the rates of the process wide limiters
+func SetLimits(limits Limits) {
+	NetworkLimiter.SetRate(limits.Network * Mbps)
+	DiskLimiter.SetRate(limits.Disk * Mbps)
+}
+
+// ServeLimits starts an http endpoint on address to change the limits of running transfers.
+// GET /limits returns the current limits, PUT /limits?network=100&disk=400 changes them.
+func ServeLimits(address string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/limits", func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			limits := CurrentLimits()
+			for name, limit := range map[string]*int{"network": &limits.Network, "disk": &limits.Disk} {
+				value := req.URL.Query().Get(name)
+				if value == "" {
+					continue
+				}
+				rate, err := strconv.Atoi(value)
+				if err != nil || rate < 0 {
+					http.Error(w, "invalid "+name+" limit ["+value+"]", http.StatusBadRequest)
+					return
+				}
+				*limit = rate
+			}
+			SetLimits(limits)
+			log.Infof("changed limits to network %d megabits/s, disk %d megabits/s", limits.Network, limits.Disk)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(CurrentLimits())
+	})
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return errors.Wrapf(err, "unable to serve limits on %s", address)
+	}
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Errorf("limits endpoint stopped: %v", err)
+		}
+	}()
+	log.Infof("serving limits on http://%s/limits", listener.Addr())
+	return nil
+}
@@ -0,0 +1,173 @@
+package snappy
+
+import (
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// SnapshotSummary describes a snapshot or incremental backup on a destination
+type SnapshotSummary struct {
+	SnapshotID string `json:"snapshot_id"`
+	// Base is the snapshot an incremental backup builds on
+	Base    string   `json:"base,omitempty"`
+	Cluster string   `json:"cluster,omitempty"`
+	Nodes   []string `json:"nodes"`
+	// Datacenters and SnappyVersions are those of the nodes, read from the manifests or the object metadata
+	Datacenters    []string `json:"datacenters,omitempty"`
+	SnappyVersions []string `json:"snappy_versions,omitempty"`
+	// IncompleteNodes have not written their completion marker yet
+	IncompleteNodes []string `json:"incomplete_nodes,omitempty"`
+	Complete        bool     `json:"complete"`
+	Keyspaces       []string `json:"keyspaces"`
+	Files           int      `json:"files"`
+	// Size is the size of the files on disk, before compression
+	Size int64 `json:"size"`
+	// StartedAt is when the first node started the backup, FinishedAt when the last node completed it
+	StartedAt  time.Time         `json:"started_at"`
+	FinishedAt time.Time         `json:"finished_at"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+// ListOptions filters the snapshots returned by ListBackups
+type ListOptions struct {
+	// Since and Until limit the snapshots to those started in the range, zero values leave it open
+	Since time.Time
+	Until time.Time
+	// Nodes limits the snapshots, and what they are summed up from, to these nodes
+	Nodes []string
+	// Keyspaces limits the snapshots, and what they are summed up from, to these keyspaces
+	Keyspaces []string
+}
+
+// ListBackups summarises the snapshots on a destination from their manifests, oldest first
+func ListBackups(config *StorageConfig, options *ListOptions) ([]SnapshotSummary, error) {
+	remote, err := OpenRemote(config)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := remote.ListSnapshots()
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := []SnapshotSummary{}
+	for _, id := range ids {
+		summary, err := remote.summarize(id, options)
+		if err != nil {
+			return nil, err
+		}
+		if summary == nil {
+			continue
+		}
+		if !options.Since.IsZero() && summary.StartedAt.Before(options.Since) {
+			continue
+		}
+		if !options.Until.IsZero() && summary.StartedAt.After(options.Until) {
+			continue
+		}
+		summaries = append(summaries, *summary)
+	}
+
+	sort.SliceStable(summaries, func(i, j int) bool { return summaries[i].StartedAt.Before(summaries[j].StartedAt) })
+	return summaries, nil
+}
+
+// summarize reads the manifests of a snapshot, it returns nil when the filters exclude the snapshot
+func (r *Remote) summarize(snapshotID string, options *ListOptions) (*SnapshotSummary, error) {
+	summary := &SnapshotSummary{SnapshotID: snapshotID}
+	var (
+		keyspaces   = make(map[string]bool)
+		datacenters = make(map[string]bool)
+		versions    = make(map[string]bool)
+	)
+
+	for _, node := range r.ListNodes(snapshotID) {
+		if len(options.Nodes) > 0 && !contains(options.Nodes, node) {
+			continue
+		}
+		manifest, err := r.LoadManifest(snapshotID, node)
+		if err != nil {
+			return nil, err
+		}
+		if manifest.CreatedAt.IsZero() {
+			r.describeFromMetadata(manifest, false)
+		}
+
+		var files int
+		for _, file := range manifest.Files {
+			if len(options.Keyspaces) > 0 && !contains(options.Keyspaces, file.Keyspace) {
+				continue
+			}
+			files++
+			keyspaces[file.Keyspace] = true
+			summary.Size += fileSize(file)
+		}
+		if len(options.Keyspaces) > 0 && files == 0 {
+			continue
+		}
+		summary.Files += files
+		summary.Nodes = append(summary.Nodes, node)
+
+		// manifests rebuilt from a listing only know what the object metadata tells
+		if manifest.Cluster != "" {
+			summary.Cluster, summary.Base = manifest.Cluster, manifest.Base
+		}
+		if manifest.Node.Datacenter != "" {
+			datacenters[manifest.Node.Datacenter] = true
+		}
+		if manifest.Version != "" {
+			versions[manifest.Version] = true
+		}
+		if !manifest.CreatedAt.IsZero() && (summary.StartedAt.IsZero() || manifest.CreatedAt.Before(summary.StartedAt)) {
+			summary.StartedAt = manifest.CreatedAt
+		}
+		for k, v := range manifest.Labels {
+			if summary.Labels == nil {
+				summary.Labels = make(map[string]string)
+			}
+			summary.Labels[k] = v
+		}
+
+		info, err := r.storage.Head(filepath.Join(SnapshotFolderPrefix, snapshotID, node, SnapshotCompleted))
+		if err != nil {
+			summary.IncompleteNodes = append(summary.IncompleteNodes, node)
+			continue
+		}
+		if info.LastModified.After(summary.FinishedAt) {
+			summary.FinishedAt = info.LastModified
+		}
+		// snapshots taken before manifests were written are dated by their completion markers
+		if manifest.CreatedAt.IsZero() && (summary.StartedAt.IsZero() || info.LastModified.Before(summary.StartedAt)) {
+			summary.StartedAt = info.LastModified
+		}
+	}
+	if len(summary.Nodes) == 0 && (len(options.Nodes) > 0 || len(options.Keyspaces) > 0) {
+		return nil, nil
+	}
+
+	summary.Keyspaces = sortedSet(keyspaces)
+	summary.Datacenters = sortedSet(datacenters)
+	summary.SnappyVersions = sortedSet(versions)
+
+	// incremental backups are only marked complete per node
+	if summary.Base != "" {
+		summary.Complete = len(summary.Nodes) > 0 && len(summary.IncompleteNodes) == 0
+	} else {
+		summary.Complete = r.IsClusterSnapshotComplete(snapshotID)
+	}
+	if !summary.Complete {
+		summary.FinishedAt = time.Time{}
+	}
+	return summary, nil
+}
+
+// sortedSet returns the members of a set in order
+func sortedSet(set map[string]bool) []string {
+	var members []string
+	for member := range set {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	return members
+}
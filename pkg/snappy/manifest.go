@@ -0,0 +1,332 @@
+package snappy
+
+import (
+	"bytes"
+	"encoding/json"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// ManifestFilename is written next to the keyspaces of every node snapshot
+const ManifestFilename = "manifest.json"
+
+// Manifest lists everything a node snapshot contains, so restores do not have to walk the destination
+type Manifest struct {
+	SnapshotID string `json:"snapshot_id"`
+	// Base is the snapshot an incremental backup builds on, empty for snapshots
+	Base      string    `json:"base,omitempty"`
+	Cluster   string    `json:"cluster"`
+	CreatedAt time.Time `json:"created_at"`
+	Version   string    `json:"snappy_version"`
+	// Labels are free form key value pairs given to the backup, e.g. the reason it was taken
+	Labels map[string]string `json:"labels,omitempty"`
+	Node   ManifestNode      `json:"node"`
+	Files  []ManifestFile    `json:"files"`
+}
+
+// ManifestNode describes the node a snapshot was taken on
+type ManifestNode struct {
+	Address          string   `json:"address"`
+	HostID           string   `json:"host_id"`
+	Datacenter       string   `json:"datacenter"`
+	Rack             string   `json:"rack"`
+	CassandraVersion string   `json:"cassandra_version"`
+	Partitioner      string   `json:"partitioner"`
+	Tokens           []string `json:"tokens"`
+}
+
+// ManifestFile is a single file of a node snapshot
+type ManifestFile struct {
+	// Key is the location of the file relative to the root of the destination
+	Key       string `json:"key"`
+	Keyspace  string `json:"keyspace"`
+	Table     string `json:"table"`
+	TableUUID string `json:"table_uuid"`
+	// Component is the SSTable component such as Data.db or Index.db
+	Component string `json:"component"`
+	Size      int64  `json:"size"`
+	// Checksum is the hex encoded sha256 of the file, empty when the manifest was rebuilt from a listing
+	Checksum string `json:"checksum,omitempty"`
+	// Object is the key holding the content of the file when it differs from Key, the shared
+	// content addressed object when it was deduplicated or the compressed object
+	Object string `json:"object,omitempty"`
+	// Compression is the codec the object was compressed with
+	Compression string `json:"compression,omitempty"`
+	// KeyID is the master key the object was encrypted with
+	KeyID string `json:"key_id,omitempty"`
+	// StoredSize is the size of the object when it was compressed or encrypted
+	StoredSize int64 `json:"stored_size,omitempty"`
+}
+
+// NewManifest describes the local node for a snapshot, details that cannot be
+// read from nodetool are left empty rather than failing the backup
+func NewManifest(cassandra *Cassandra, nodeIP, snapshotID string) *Manifest {
+	manifest := &Manifest{
+		SnapshotID: snapshotID,
+		Cluster:    cassandra.GetClusterName(),
+		CreatedAt:  time.Now().UTC(),
+		Version:    Version,
+		Node: ManifestNode{
+			Address:     nodeIP,
+			Partitioner: cassandra.GetPartitioner(),
+		},
+	}
+
+	if info, err := cassandra.GetNodeInfo(); err != nil {
+		log.Warnf("unable to read node info, manifest will not include host id, datacenter and tokens: %v", err)
+	} else {
+		manifest.Node.HostID = info.HostID
+		manifest.Node.Datacenter = info.Datacenter
+		manifest.Node.Rack = info.Rack
+		manifest.Node.Tokens = info.Tokens
+	}
+
+	if version, err := cassandra.GetVersion(); err != nil {
+		log.Warnf("unable to read cassandra version: %v", err)
+	} else {
+		manifest.Node.CassandraVersion = version
+	}
+	return manifest
+}
+
+// newManifestFile describes a snapshot file from its key,
+// backups/<snapshot id>/<node>/<keyspace>/<table>-<uuid>/<file>
+func newManifestFile(key string, size int64) ManifestFile {
+	file := ManifestFile{Key: key, Size: size}
+
+	parts := strings.Split(key, "/")
+	if len(parts) > 5 {
+		file.Keyspace = parts[3]
+		file.Table, file.TableUUID = Split(parts[4], "-")
+	}
+
+	base := path.Base(key)
+	if idx := strings.LastIndex(base, "-"); idx >= 0 {
+		file.Component = base[idx+1:]
+	} else {
+		file.Component = base
+	}
+	return file
+}
+
+// objectFile describes an object found by listing, its encoding is recognised from the extensions of its key
+func objectFile(obj ObjectInfo) ManifestFile {
+	codec, encrypted, key := encodingFromKey(obj.Key)
+	if key == obj.Key {
+		return newManifestFile(obj.Key, obj.Size)
+	}
+
+	// the size of the file is unknown, it is downloaded again rather than skipped
+	file := newManifestFile(key, -1)
+	file.Object, file.Compression, file.StoredSize = obj.Key, codec, obj.Size
+	if encrypted {
+		// the key id is also in the header of the object, metadata only helps to report it
+		file.KeyID = "unknown"
+		if id := obj.Metadata[MetadataKeyID]; id != "" {
+			file.KeyID = id
+		}
+	}
+	return file
+}
+
+// Path returns the location of the file inside a node snapshot, <keyspace>/<table>-<uuid>/<file>
+func (f ManifestFile) Path() string {
+	parts := strings.SplitN(f.Key, "/", 4)
+	return parts[len(parts)-1]
+}
+
+// ObjectKey returns the key the content of the file is stored at
+func (f ManifestFile) ObjectKey() string {
+	if f.Object != "" {
+		return f.Object
+	}
+	return f.Key
+}
+
+// ObjectSize returns the size of the object the content of the file is stored in
+func (f ManifestFile) ObjectSize() int64 {
+	if f.StoredSize > 0 {
+		return f.StoredSize
+	}
+	return f.Size
+}
+
+// sharedObjectKey returns the content addressed key of a file, shared/<sha256[:2]>/<sha256>
+func sharedObjectKey(checksum string) string {
+	return path.Join(SharedFolderPrefix, checksum[:2], checksum)
+}
+
+// Metadata returns the object metadata uploaded with file
+func (m *Manifest) Metadata(file ManifestFile) map[string]string {
+	metadata := make(map[string]string)
+	for k, v := range map[string]string{
+		MetadataCluster:    m.Cluster,
+		MetadataDatacenter: m.Node.Datacenter,
+		MetadataNode:       m.Node.Address,
+		MetadataHostID:     m.Node.HostID,
+		MetadataKeyspace:   file.Keyspace,
+		MetadataTable:      file.Table,
+		MetadataSnapshotID: m.SnapshotID,
+		MetadataVersion:    m.Version,
+		MetadataChecksum:   file.Checksum,
+		MetadataCodec:      file.Compression,
+		MetadataKeyID:      file.KeyID,
+	} {
+		if v != "" {
+			metadata[k] = v
+		}
+	}
+	return metadata
+}
+
+// Tables returns the keyspaces in the snapshot with the tables of each, as <table>-<uuid>
+func (m *Manifest) Tables() map[string][]string {
+	var (
+		tables = make(map[string][]string)
+		seen   = make(map[string]bool)
+	)
+	for _, file := range m.Files {
+		table := file.Table + "-" + file.TableUUID
+		if file.Keyspace == "" || seen[file.Keyspace+"/"+table] {
+			continue
+		}
+		seen[file.Keyspace+"/"+table] = true
+		tables[file.Keyspace] = append(tables[file.Keyspace], table)
+	}
+	for _, list := range tables {
+		sort.Strings(list)
+	}
+	return tables
+}
+
+// TableFiles returns every file belonging to a table
+func (m *Manifest) TableFiles(keyspace, table, uuid string) []ManifestFile {
+	var files []ManifestFile
+	for _, file := range m.Files {
+		if file.Keyspace == keyspace && file.Table == table && file.TableUUID == uuid {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// manifestKey returns the key of the manifest of a node snapshot
+func manifestKey(snapshotID, node string) string {
+	return filepath.Join(SnapshotFolderPrefix, snapshotID, node, ManifestFilename)
+}
+
+// WriteManifest uploads the manifest of a node snapshot
+func (r *Remote) WriteManifest(manifest *Manifest) error {
+	sort.Slice(manifest.Files, func(i, j int) bool { return manifest.Files[i].Key < manifest.Files[j].Key })
+
+	data, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		return err
+	}
+	key := manifestKey(manifest.SnapshotID, manifest.Node.Address)
+	if err := r.storage.Put(key, bytes.NewReader(data), PutOptions{}); err != nil {
+		return errors.Wrapf(err, "error uploading %s", key)
+	}
+	return nil
+}
+
+// ReadManifest downloads the manifest of a node snapshot, returning ErrNotExist
+// for snapshots taken before manifests were written
+func (r *Remote) ReadManifest(snapshotID, node string) (*Manifest, error) {
+	body, err := r.storage.Get(manifestKey(snapshotID, node))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	manifest := &Manifest{}
+	if err := json.NewDecoder(body).Decode(manifest); err != nil {
+		return nil, errors.Wrapf(err, "invalid manifest for node [%s]", node)
+	}
+	return manifest, nil
+}
+
+// LoadManifest reads the manifest of a node snapshot, or rebuilds one by listing
+// the snapshot when it was uploaded without a manifest
+func (r *Remote) LoadManifest(snapshotID, node string) (*Manifest, error) {
+	manifest, err := r.ReadManifest(snapshotID, node)
+	if err != ErrNotExist {
+		return manifest, err
+	}
+
+	log.Debugf("no manifest found for node [%s], listing snapshot files", node)
+	prefix := filepath.Join(SnapshotFolderPrefix, snapshotID, node) + "/"
+	listing, err := r.storage.List(prefix, "")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list snapshot files")
+	}
+
+	manifest = &Manifest{SnapshotID: snapshotID, Node: ManifestNode{Address: node}}
+	for _, obj := range listing.Objects {
+		file := objectFile(obj)
+		if file.Keyspace == "" {
+			// the completion marker and other files outside of a table
+			continue
+		}
+		manifest.Files = append(manifest.Files, file)
+	}
+	return manifest, nil
+}
+
+// describeFromMetadata fills in a manifest rebuilt from a listing with the metadata uploaded with its objects:
+// the cluster, node and snappy version from its first object and, with checksums, the checksum of every file
+func (r *Remote) describeFromMetadata(manifest *Manifest, checksums bool) {
+	for i := range manifest.Files {
+		if i > 0 && !checksums {
+			return
+		}
+		file := &manifest.Files[i]
+		info, err := r.storage.Head(file.ObjectKey())
+		if err != nil || info.Metadata == nil {
+			continue
+		}
+		if manifest.Cluster == "" {
+			manifest.Cluster = info.Metadata[MetadataCluster]
+			manifest.Version = info.Metadata[MetadataVersion]
+			manifest.Node.Datacenter = info.Metadata[MetadataDatacenter]
+			manifest.Node.HostID = info.Metadata[MetadataHostID]
+		}
+		if file.Checksum == "" {
+			file.Checksum = info.Metadata[MetadataChecksum]
+		}
+	}
+}
+
+// SharedReferences counts how many files in the manifests of every snapshot on the remote
+// reference each shared object, a shared object can be deleted once its count drops to zero
+func (r *Remote) SharedReferences() (map[string]int, error) {
+	references := make(map[string]int)
+
+	snapshots, err := r.ListSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	for _, snapshotID := range snapshots {
+		for _, node := range r.ListNodes(snapshotID) {
+			manifest, err := r.ReadManifest(snapshotID, node)
+			if err == ErrNotExist {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			for _, file := range manifest.Files {
+				if strings.HasPrefix(file.Object, SharedFolderPrefix+"/") {
+					references[file.Object]++
+				}
+			}
+		}
+	}
+	return references, nil
+}
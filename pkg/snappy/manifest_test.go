@@ -0,0 +1,105 @@
+package snappy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestObjectFile(t *testing.T) {
+	tests := []struct {
+		name string
+		obj  ObjectInfo
+		want ManifestFile
+	}{
+		{
+			name: "sstable component",
+			obj:  ObjectInfo{Key: "backups/s1/10.0.0.1/ks1/t1-aaa/mc-1-big-Data.db", Size: 10},
+			want: ManifestFile{
+				Key: "backups/s1/10.0.0.1/ks1/t1-aaa/mc-1-big-Data.db", Keyspace: "ks1", Table: "t1", TableUUID: "aaa",
+				Component: "Data.db", Size: 10,
+			},
+		},
+		{
+			name: "table schema",
+			obj:  ObjectInfo{Key: "backups/s1/10.0.0.1/ks1/t1-aaa/schema.cql", Size: 5},
+			want: ManifestFile{
+				Key: "backups/s1/10.0.0.1/ks1/t1-aaa/schema.cql", Keyspace: "ks1", Table: "t1", TableUUID: "aaa",
+				Component: "schema.cql", Size: 5,
+			},
+		},
+		{
+			name: "file outside of a table",
+			obj:  ObjectInfo{Key: "backups/s1/10.0.0.1/SNAPSHOT_COMPLETED"},
+			want: ManifestFile{Key: "backups/s1/10.0.0.1/SNAPSHOT_COMPLETED", Component: "SNAPSHOT_COMPLETED"},
+		},
+		{
+			name: "compressed object",
+			obj:  ObjectInfo{Key: "backups/s1/10.0.0.1/ks1/t1-aaa/mc-1-big-Data.db.zst", Size: 4},
+			want: ManifestFile{
+				Key: "backups/s1/10.0.0.1/ks1/t1-aaa/mc-1-big-Data.db", Keyspace: "ks1", Table: "t1", TableUUID: "aaa",
+				Component: "Data.db", Size: -1, Object: "backups/s1/10.0.0.1/ks1/t1-aaa/mc-1-big-Data.db.zst",
+				Compression: CodecZstd, StoredSize: 4,
+			},
+		},
+		{
+			name: "compressed and encrypted object with its key id in the metadata",
+			obj: ObjectInfo{
+				Key: "backups/s1/10.0.0.1/ks1/t1-aaa/mc-1-big-Data.db.lz4.enc", Size: 40,
+				Metadata: map[string]string{MetadataKeyID: "local:0011223344556677"},
+			},
+			want: ManifestFile{
+				Key: "backups/s1/10.0.0.1/ks1/t1-aaa/mc-1-big-Data.db", Keyspace: "ks1", Table: "t1", TableUUID: "aaa",
+				Component: "Data.db", Size: -1, Object: "backups/s1/10.0.0.1/ks1/t1-aaa/mc-1-big-Data.db.lz4.enc",
+				Compression: CodecLZ4, KeyID: "local:0011223344556677", StoredSize: 40,
+			},
+		},
+		{
+			name: "encrypted object without metadata",
+			obj:  ObjectInfo{Key: "backups/s1/10.0.0.1/ks1/t1-aaa/mc-1-big-Index.db.enc", Size: 40},
+			want: ManifestFile{
+				Key: "backups/s1/10.0.0.1/ks1/t1-aaa/mc-1-big-Index.db", Keyspace: "ks1", Table: "t1", TableUUID: "aaa",
+				Component: "Index.db", Size: -1, Object: "backups/s1/10.0.0.1/ks1/t1-aaa/mc-1-big-Index.db.enc",
+				KeyID: "unknown", StoredSize: 40,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := objectFile(tt.obj); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("file is %+v, expected %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadManifest(t *testing.T) {
+	remote := testRemote(t)
+	written := testManifest("s1", "", "mc-1-big-TOC.txt", "mc-1-big-Data.db")
+	written.Cluster = "test"
+	if err := remote.WriteManifest(written); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := remote.LoadManifest("s1", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(manifest, written) {
+		t.Errorf("manifest is %+v, expected %+v", manifest, written)
+	}
+
+	// snapshots uploaded before manifests existed are listed instead
+	for _, file := range testManifest("s0", "", "mc-1-big-Data.db", "mc-1-big-TOC.txt").Files {
+		putObject(t, remote, file.Key, []byte("data"))
+	}
+	putObject(t, remote, "backups/s0/10.0.0.1/"+SnapshotCompleted, nil)
+	manifest, err = remote.LoadManifest("s0", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := paths(manifest); !reflect.DeepEqual(got, []string{"ks1/t1-aaa/mc-1-big-Data.db", "ks1/t1-aaa/mc-1-big-TOC.txt"}) {
+		t.Errorf("listed files are %v", got)
+	}
+	if manifest.SnapshotID != "s0" || manifest.Node.Address != "10.0.0.1" {
+		t.Errorf("listed manifest is for snapshot %s of node %s", manifest.SnapshotID, manifest.Node.Address)
+	}
+}
@@ -0,0 +1,78 @@
+package snappy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Version of snappy, recorded on every uploaded file
+var Version string
+
+// Metadata keys attached to every uploaded file. Keys only use lowercase letters and
+// underscores so they are valid as S3 tags, GCS metadata and Azure metadata names.
+const (
+	MetadataCluster    = "cluster"
+	MetadataDatacenter = "datacenter"
+	MetadataNode       = "node"
+	MetadataHostID     = "host_id"
+	MetadataKeyspace   = "keyspace"
+	MetadataTable      = "table"
+	MetadataSnapshotID = "snapshot_id"
+	MetadataVersion    = "snappy_version"
+	MetadataChecksum   = "sha256"
+	MetadataCodec      = "compression"
+	MetadataKeyID      = "key_id"
+)
+
+// taggedMetadata are also written as S3 object tags so lifecycle rules and cost
+// reports can filter on them, S3 allows at most 10 tags per object
+var taggedMetadata = []string{
+	MetadataCluster,
+	MetadataDatacenter,
+	MetadataNode,
+	MetadataKeyspace,
+	MetadataTable,
+	MetadataSnapshotID,
+}
+
+// objectTags encodes the tagged subset of metadata as an S3 tagging header
+func objectTags(metadata map[string]string) string {
+	tags := url.Values{}
+	for _, key := range taggedMetadata {
+		if value := metadata[key]; value != "" {
+			tags.Set(key, value)
+		}
+	}
+	return tags.Encode()
+}
+
+// normalizeMetadata lowercases metadata names, backends return them in header case
+func normalizeMetadata(metadata map[string]string) map[string]string {
+	if len(metadata) == 0 {
+		return nil
+	}
+	normalized := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		normalized[strings.ToLower(k)] = v
+	}
+	return normalized
+}
+
+// fileChecksum returns the hex encoded sha256 of a local file, the read counts against the disk limit
+func fileChecksum(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, DiskLimiter.Reader(f)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -1,8 +1,13 @@
 package snappy
 
 import (
-	"errors"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
 	"net"
+	"net/http"
+
+	"github.com/pkg/errors"
 )
 
 // GetLocalIP returns the first non-loopback device
@@ -21,3 +26,31 @@ func GetLocalIP() (string, error) {
 	}
 	return "", errors.New("could not find a local ip")
 }
+
+// NewHTTPClient returns an http client that trusts the certificates in caBundle
+// in addition to the system pool, optionally skipping verification entirely
+func NewHTTPClient(caBundle string, insecure bool) (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+
+	if caBundle != "" {
+		pemCerts, err := ioutil.ReadFile(caBundle)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read ca bundle [%s]", caBundle)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pemCerts) {
+			return nil, errors.Errorf("no certificates found in ca bundle [%s]", caBundle)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     tlsConfig,
+		MaxIdleConnsPerHost: 16,
+	}
+	return &http.Client{Transport: transport}, nil
+}
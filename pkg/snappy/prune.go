@@ -0,0 +1,408 @@
+package snappy
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// RetentionPolicy decides which snapshots prune keeps, a snapshot kept by any rule is kept.
+// The daily, weekly and monthly rules keep the newest snapshot of each of the last N days, weeks and months.
+type RetentionPolicy struct {
+	KeepLast    int
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+	// MaxAge deletes snapshots older than this even when a rule keeps them, 0 keeps snapshots of any age
+	MaxAge time.Duration
+}
+
+// PruneOptions selects the snapshots prune applies a policy to
+type PruneOptions struct {
+	Policy RetentionPolicy
+	// Cluster limits pruning to the snapshots of a cluster, snapshots of other clusters are left alone
+	Cluster string
+	// Keyspaces limits pruning to the files of these keyspaces, the snapshots themselves are kept
+	Keyspaces []string
+	// SharedGrace keeps unreferenced shared objects modified within this window, a backup
+	// running at the same time may have uploaded them without having written its manifest yet
+	SharedGrace time.Duration
+	// DryRun only reports what would be deleted
+	DryRun bool
+}
+
+// PruneDecision is what prune does with a snapshot and why
+type PruneDecision struct {
+	SnapshotID string
+	// Base is the snapshot an incremental backup builds on
+	Base      string
+	CreatedAt time.Time
+	Complete  bool
+	Keep      bool
+	Reason    string
+}
+
+// pruneSnapshot is a snapshot on the remote with the manifests of its nodes
+type pruneSnapshot struct {
+	PruneDecision
+	cluster   string
+	manifests map[string]*Manifest
+}
+
+// Prune applies a retention policy to the snapshots on a destination. The newest complete snapshot,
+// snapshots that may still be uploading and snapshots an incremental backup that is kept builds on
+// are never deleted. Shared objects are deleted once no manifest references them any more.
+// Prune must not run while a backup with deduplication writes to the same destination, the
+// backup may reuse a shared object prune is about to delete.
+func Prune(config *StorageConfig, options *PruneOptions) ([]PruneDecision, error) {
+	policy := options.Policy
+	if policy == (RetentionPolicy{}) {
+		return nil, errors.New("a retention policy is required, nothing would be kept")
+	}
+
+	remote, err := OpenRemote(config)
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := remote.pruneSnapshots(options.Cluster)
+	if err != nil {
+		return nil, err
+	}
+	inProgress := decideRetention(snapshots, policy, time.Now())
+
+	var decisions []PruneDecision
+	for _, s := range snapshots {
+		decisions = append(decisions, s.PruneDecision)
+	}
+	if options.DryRun {
+		return decisions, nil
+	}
+
+	for _, s := range snapshots {
+		if s.Keep {
+			continue
+		}
+		if err := remote.pruneSnapshot(s, options.Keyspaces); err != nil {
+			return decisions, err
+		}
+	}
+	if len(options.Keyspaces) == 0 {
+		if err := remote.pruneChains(snapshots); err != nil {
+			return decisions, err
+		}
+	}
+
+	// a backup that is still uploading may reference shared objects before its manifest is written
+	if inProgress {
+		log.Warn("a snapshot is still being uploaded, shared objects are not deleted until the next prune")
+		return decisions, nil
+	}
+	return decisions, remote.pruneShared(options.SharedGrace)
+}
+
+// pruneSnapshots reads every snapshot on the remote, newest first, skipping those of other clusters
+func (r *Remote) pruneSnapshots(cluster string) ([]*pruneSnapshot, error) {
+	ids, err := r.ListSnapshots()
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []*pruneSnapshot
+	for _, id := range ids {
+		s := &pruneSnapshot{
+			PruneDecision: PruneDecision{SnapshotID: id, Complete: r.IsClusterSnapshotComplete(id)},
+			manifests:     make(map[string]*Manifest),
+		}
+		for _, node := range r.ListNodes(id) {
+			manifest, err := r.ReadManifest(id, node)
+			if err == ErrNotExist {
+				// snapshots taken before manifests were written are dated by their completion marker
+				if info, err := r.storage.Head(filepath.Join(SnapshotFolderPrefix, id, node, SnapshotCompleted)); err == nil {
+					if s.CreatedAt.IsZero() || info.LastModified.Before(s.CreatedAt) {
+						s.CreatedAt = info.LastModified
+					}
+				}
+				s.manifests[node] = nil
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			s.manifests[node] = manifest
+			s.cluster, s.Base = manifest.Cluster, manifest.Base
+			if s.CreatedAt.IsZero() || manifest.CreatedAt.Before(s.CreatedAt) {
+				s.CreatedAt = manifest.CreatedAt
+			}
+		}
+		if cluster != "" && s.cluster != cluster {
+			continue
+		}
+		// incremental backups are only marked complete per node
+		if s.Base != "" && !s.Complete {
+			s.Complete = len(s.manifests) > 0
+			for node := range s.manifests {
+				s.Complete = s.Complete && r.IsSnapshotComplete(filepath.Join(SnapshotFolderPrefix, id, node))
+			}
+		}
+		snapshots = append(snapshots, s)
+	}
+
+	sort.SliceStable(snapshots, func(i, j int) bool { return snapshots[i].CreatedAt.After(snapshots[j].CreatedAt) })
+	return snapshots, nil
+}
+
+// decideRetention marks the snapshots to keep, sorted newest first, and reports whether one may still be uploading
+func decideRetention(snapshots []*pruneSnapshot, policy RetentionPolicy, now time.Time) bool {
+	var (
+		complete   []*pruneSnapshot
+		newest     *pruneSnapshot
+		inProgress bool
+	)
+	for _, s := range snapshots {
+		switch {
+		case s.CreatedAt.IsZero() && s.Complete:
+			s.Keep, s.Reason = true, "unknown age"
+		case s.CreatedAt.IsZero():
+			// the manifest is written once every file was uploaded
+			s.Keep, s.Reason = true, "in progress"
+			inProgress = true
+		case s.Complete:
+			if newest == nil {
+				newest = s
+			}
+			complete = append(complete, s)
+		case newest == nil:
+			s.Keep, s.Reason = true, "in progress"
+			inProgress = true
+		default:
+			s.Reason = "incomplete"
+		}
+	}
+
+	keep := func(s *pruneSnapshot, reason string) {
+		if !s.Keep {
+			s.Keep, s.Reason = true, reason
+		}
+	}
+	for i, s := range complete {
+		if i < policy.KeepLast {
+			keep(s, "last")
+		}
+	}
+	buckets := []struct {
+		count  int
+		reason string
+		bucket func(time.Time) string
+	}{
+		{policy.KeepDaily, "daily", func(t time.Time) string { return t.UTC().Format("2006-01-02") }},
+		{policy.KeepWeekly, "weekly", func(t time.Time) string {
+			year, week := t.UTC().ISOWeek()
+			return fmt.Sprintf("%d-%02d", year, week)
+		}},
+		{policy.KeepMonthly, "monthly", func(t time.Time) string { return t.UTC().Format("2006-01") }},
+	}
+	for _, rule := range buckets {
+		seen := make(map[string]bool)
+		for _, s := range complete {
+			if len(seen) >= rule.count {
+				break
+			}
+			if b := rule.bucket(s.CreatedAt); !seen[b] {
+				seen[b] = true
+				keep(s, rule.reason)
+			}
+		}
+	}
+
+	// without count rules, max age alone keeps every complete snapshot that is young enough
+	countRules := policy.KeepLast+policy.KeepDaily+policy.KeepWeekly+policy.KeepMonthly > 0
+	for _, s := range complete {
+		if policy.MaxAge > 0 && now.Sub(s.CreatedAt) > policy.MaxAge {
+			s.Keep, s.Reason = false, "older than max age"
+		} else if !countRules {
+			keep(s, "within max age")
+		} else if !s.Keep {
+			s.Reason = "not kept by policy"
+		}
+	}
+	if newest != nil {
+		newest.Keep, newest.Reason = true, "newest complete snapshot"
+	}
+
+	// an incremental backup needs its base snapshot and every earlier incremental to be restored
+	byID := make(map[string]*pruneSnapshot)
+	for _, s := range snapshots {
+		byID[s.SnapshotID] = s
+	}
+	for _, s := range snapshots {
+		if !s.Keep || s.Base == "" {
+			continue
+		}
+		if base, ok := byID[s.Base]; ok {
+			keep(base, "base of "+s.SnapshotID)
+		}
+		for _, other := range snapshots {
+			if other.Base == s.Base && other.CreatedAt.Before(s.CreatedAt) {
+				keep(other, "needed by "+s.SnapshotID)
+			}
+		}
+	}
+	return inProgress
+}
+
+// pruneSnapshot deletes a snapshot, or only the files of keyspaces from it
+func (r *Remote) pruneSnapshot(s *pruneSnapshot, keyspaces []string) error {
+	if len(keyspaces) > 0 {
+		return r.pruneKeyspaces(s, keyspaces)
+	}
+
+	log.Infof("deleting snapshot [%s] from [%s]", s.SnapshotID, r)
+	// without the cluster marker a partly deleted snapshot is refused by restore
+	if err := r.storage.Delete(filepath.Join(SnapshotFolderPrefix, s.SnapshotID, SnapshotCompleted)); err != nil {
+		return errors.Wrapf(err, "unable to delete snapshot [%s]", s.SnapshotID)
+	}
+	if err := r.deletePrefix(filepath.Join(SnapshotFolderPrefix, s.SnapshotID) + "/"); err != nil {
+		return errors.Wrapf(err, "unable to delete snapshot [%s]", s.SnapshotID)
+	}
+	return nil
+}
+
+// pruneKeyspaces deletes the files of keyspaces from every node of a snapshot and rewrites the manifests without them
+func (r *Remote) pruneKeyspaces(s *pruneSnapshot, keyspaces []string) error {
+	log.Infof("deleting keyspaces %s from snapshot [%s] on [%s]", strings.Join(keyspaces, ", "), s.SnapshotID, r)
+	for node, manifest := range s.manifests {
+		if manifest == nil {
+			for _, keyspace := range keyspaces {
+				if err := r.deletePrefix(filepath.Join(SnapshotFolderPrefix, s.SnapshotID, node, keyspace) + "/"); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		var files []ManifestFile
+		for _, file := range manifest.Files {
+			if !contains(keyspaces, file.Keyspace) {
+				files = append(files, file)
+				continue
+			}
+			if isShared(file) {
+				continue
+			}
+			if err := r.storage.Delete(file.ObjectKey()); err != nil {
+				return errors.Wrapf(err, "unable to delete %s", file.ObjectKey())
+			}
+		}
+		if len(files) == len(manifest.Files) {
+			continue
+		}
+		manifest.Files = files
+		if err := r.WriteManifest(manifest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneChains removes deleted incremental backups from the chains of the snapshots that are kept
+func (r *Remote) pruneChains(snapshots []*pruneSnapshot) error {
+	deleted := make(map[string]bool)
+	for _, s := range snapshots {
+		if !s.Keep {
+			deleted[s.SnapshotID] = true
+		}
+	}
+
+	for _, s := range snapshots {
+		if !s.Keep || s.Base != "" {
+			continue
+		}
+		for node := range s.manifests {
+			chain, err := r.ReadChain(s.SnapshotID, node)
+			if err != nil {
+				return err
+			}
+			var incrementals []string
+			for _, id := range chain.Incrementals {
+				if !deleted[id] {
+					incrementals = append(incrementals, id)
+				}
+			}
+			if len(incrementals) == len(chain.Incrementals) {
+				continue
+			}
+			chain.Incrementals = incrementals
+			if err := r.writeChain(node, chain); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pruneShared deletes the shared objects that no manifest references any more and that were not
+// modified within the grace period, objects kept by the grace period are deleted by a later prune
+func (r *Remote) pruneShared(grace time.Duration) error {
+	listing, err := r.storage.List(SharedFolderPrefix+"/", "")
+	if err != nil {
+		return errors.Wrap(err, "failed to list shared objects")
+	}
+
+	var (
+		candidates []string
+		cutoff     = time.Now().Add(-grace)
+	)
+	for _, obj := range listing.Objects {
+		if obj.LastModified.After(cutoff) {
+			log.Debugf("shared object [%s] was modified within %s, keeping it", obj.Key, grace)
+			continue
+		}
+		candidates = append(candidates, obj.Key)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	// read as late as possible, so manifests written in the meantime are counted
+	references, err := r.SharedReferences()
+	if err != nil {
+		return err
+	}
+
+	var deleted int
+	for _, key := range candidates {
+		if references[key] > 0 {
+			continue
+		}
+		if err := r.storage.Delete(key); err != nil {
+			return errors.Wrapf(err, "unable to delete %s", key)
+		}
+		deleted++
+	}
+	log.Infof("deleted %d shared objects that are no longer referenced", deleted)
+	return nil
+}
+
+// deletePrefix deletes every object under prefix
+func (r *Remote) deletePrefix(prefix string) error {
+	listing, err := r.storage.List(prefix, "")
+	if err != nil {
+		return err
+	}
+	for _, obj := range listing.Objects {
+		if err := r.storage.Delete(obj.Key); err != nil {
+			return errors.Wrapf(err, "unable to delete %s", obj.Key)
+		}
+	}
+	return nil
+}
+
+// isShared reports whether a file is stored as a shared, content addressed object
+func isShared(file ManifestFile) bool {
+	return strings.HasPrefix(file.Object, SharedFolderPrefix+"/")
+}
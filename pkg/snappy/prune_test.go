@@ -0,0 +1,250 @@
+package snappy
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestDecideRetention(t *testing.T) {
+	now := time.Date(2018, 8, 31, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+
+	type snapshot struct {
+		id       string
+		base     string
+		age      time.Duration
+		complete bool
+	}
+	tests := []struct {
+		name       string
+		snapshots  []snapshot
+		policy     RetentionPolicy
+		want       map[string]string
+		inProgress bool
+	}{
+		{
+			name: "keep last",
+			snapshots: []snapshot{
+				{id: "s3", age: 1 * day, complete: true},
+				{id: "s2", age: 2 * day, complete: true},
+				{id: "s1", age: 3 * day, complete: true},
+			},
+			policy: RetentionPolicy{KeepLast: 2},
+			want: map[string]string{
+				"s3": "keep: newest complete snapshot",
+				"s2": "keep: last",
+				"s1": "delete: not kept by policy",
+			},
+		},
+		{
+			name: "keep daily takes the newest snapshot of each day",
+			snapshots: []snapshot{
+				{id: "s4", age: 1 * time.Hour, complete: true},
+				{id: "s3", age: 2 * time.Hour, complete: true},
+				{id: "s2", age: 1 * day, complete: true},
+				{id: "s1", age: 2 * day, complete: true},
+			},
+			policy: RetentionPolicy{KeepDaily: 2},
+			want: map[string]string{
+				"s4": "keep: newest complete snapshot",
+				"s3": "delete: not kept by policy",
+				"s2": "keep: daily",
+				"s1": "delete: not kept by policy",
+			},
+		},
+		{
+			name: "keep weekly and monthly",
+			snapshots: []snapshot{
+				{id: "s4", age: 1 * day, complete: true},
+				{id: "s3", age: 8 * day, complete: true},
+				{id: "s2", age: 9 * day, complete: true},
+				{id: "s1", age: 40 * day, complete: true},
+			},
+			policy: RetentionPolicy{KeepWeekly: 2, KeepMonthly: 2},
+			want: map[string]string{
+				"s4": "keep: newest complete snapshot",
+				"s3": "keep: weekly",
+				"s2": "delete: not kept by policy",
+				"s1": "keep: monthly",
+			},
+		},
+		{
+			name: "max age overrides count rules but not the newest snapshot",
+			snapshots: []snapshot{
+				{id: "s2", age: 10 * day, complete: true},
+				{id: "s1", age: 20 * day, complete: true},
+			},
+			policy: RetentionPolicy{KeepLast: 5, MaxAge: 5 * day},
+			want: map[string]string{
+				"s2": "keep: newest complete snapshot",
+				"s1": "delete: older than max age",
+			},
+		},
+		{
+			name: "max age alone keeps young snapshots",
+			snapshots: []snapshot{
+				{id: "s3", age: 1 * day, complete: true},
+				{id: "s2", age: 2 * day, complete: true},
+				{id: "s1", age: 9 * day, complete: true},
+			},
+			policy: RetentionPolicy{MaxAge: 7 * day},
+			want: map[string]string{
+				"s3": "keep: newest complete snapshot",
+				"s2": "keep: within max age",
+				"s1": "delete: older than max age",
+			},
+		},
+		{
+			name: "incomplete snapshots newer than the newest complete one may still be uploading",
+			snapshots: []snapshot{
+				{id: "s3", age: 1 * time.Hour},
+				{id: "s2", age: 1 * day, complete: true},
+				{id: "s1", age: 2 * day},
+			},
+			policy: RetentionPolicy{KeepLast: 1},
+			want: map[string]string{
+				"s3": "keep: in progress",
+				"s2": "keep: newest complete snapshot",
+				"s1": "delete: incomplete",
+			},
+			inProgress: true,
+		},
+		{
+			name: "snapshots without a date",
+			snapshots: []snapshot{
+				{id: "s2", complete: true},
+				{id: "s1"},
+			},
+			policy: RetentionPolicy{KeepLast: 1},
+			want: map[string]string{
+				"s2": "keep: unknown age",
+				"s1": "keep: in progress",
+			},
+			inProgress: true,
+		},
+		{
+			name: "a kept incremental keeps its base and earlier incrementals",
+			snapshots: []snapshot{
+				{id: "i2", base: "b1", age: 1 * day, complete: true},
+				{id: "i1", base: "b1", age: 2 * day, complete: true},
+				{id: "b1", age: 3 * day, complete: true},
+				{id: "b0", age: 4 * day, complete: true},
+			},
+			policy: RetentionPolicy{KeepLast: 1},
+			want: map[string]string{
+				"i2": "keep: newest complete snapshot",
+				"i1": "keep: needed by i2",
+				"b1": "keep: base of i2",
+				"b0": "delete: not kept by policy",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var snapshots []*pruneSnapshot
+			for _, s := range tt.snapshots {
+				var createdAt time.Time
+				if s.age > 0 {
+					createdAt = now.Add(-s.age)
+				}
+				snapshots = append(snapshots, &pruneSnapshot{PruneDecision: PruneDecision{
+					SnapshotID: s.id,
+					Base:       s.base,
+					CreatedAt:  createdAt,
+					Complete:   s.complete,
+				}})
+			}
+
+			inProgress := decideRetention(snapshots, tt.policy, now)
+			if inProgress != tt.inProgress {
+				t.Errorf("in progress is %t, expected %t", inProgress, tt.inProgress)
+			}
+			for _, s := range snapshots {
+				action := "delete"
+				if s.Keep {
+					action = "keep"
+				}
+				if got := action + ": " + s.Reason; got != tt.want[s.SnapshotID] {
+					t.Errorf("snapshot %s: got %q, expected %q", s.SnapshotID, got, tt.want[s.SnapshotID])
+				}
+			}
+		})
+	}
+}
+
+// putSharedSnapshot stores a complete snapshot of node 10.0.0.1 whose files are the given shared objects
+func putSharedSnapshot(t *testing.T, remote *Remote, snapshotID string, createdAt time.Time, objects ...string) {
+	t.Helper()
+	manifest := &Manifest{SnapshotID: snapshotID, CreatedAt: createdAt, Node: ManifestNode{Address: "10.0.0.1"}}
+	for _, object := range objects {
+		if _, err := remote.storage.Head(object); err == ErrNotExist {
+			putObject(t, remote, object, []byte(object))
+		}
+		file := newManifestFile("backups/"+snapshotID+"/10.0.0.1/ks1/t1-aaa/"+path.Base(object), int64(len(object)))
+		file.Object = object
+		manifest.Files = append(manifest.Files, file)
+	}
+	if err := remote.WriteManifest(manifest); err != nil {
+		t.Fatal(err)
+	}
+	remote.MarkSnapshotComplete("backups/"+snapshotID, "10.0.0.1")
+	if _, err := remote.MarkClusterSnapshotComplete(snapshotID, []string{"10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	var (
+		root   = t.TempDir()
+		config = &StorageConfig{Destination: "file://" + root}
+		now    = time.Now()
+	)
+	remote, err := OpenRemote(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putSharedSnapshot(t, remote, "s1", now.Add(-2*time.Hour), "shared/aa/first", "shared/bb/both")
+	putSharedSnapshot(t, remote, "s2", now.Add(-time.Hour), "shared/bb/both", "shared/cc/second")
+	// orphans of a backup that failed, or of one that has not written its manifest yet
+	putObject(t, remote, "shared/00/old", []byte("old"))
+	putObject(t, remote, "shared/00/new", []byte("new"))
+
+	// everything but the new orphan was uploaded before the grace period
+	old := now.Add(-2 * time.Hour)
+	for _, key := range []string{"shared/aa/first", "shared/bb/both", "shared/cc/second", "shared/00/old"} {
+		if err := os.Chtimes(filepath.Join(root, filepath.FromSlash(key)), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	decisions, err := Prune(config, &PruneOptions{Policy: RetentionPolicy{KeepLast: 1}, SharedGrace: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decisions) != 2 || !decisions[0].Keep || decisions[1].Keep || decisions[1].SnapshotID != "s1" {
+		t.Fatalf("prune decisions are %+v, expected to keep s2 and delete s1", decisions)
+	}
+	if snapshots, _ := remote.ListSnapshots(); !reflect.DeepEqual(snapshots, []string{"s2"}) {
+		t.Errorf("snapshots left are %v, expected s2", snapshots)
+	}
+
+	listing, err := remote.storage.List("shared/", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var shared []string
+	for _, obj := range listing.Objects {
+		shared = append(shared, obj.Key)
+	}
+	sort.Strings(shared)
+	// the objects of the deleted snapshot and the old orphan are gone, the new orphan is within the grace period
+	if expected := []string{"shared/00/new", "shared/bb/both", "shared/cc/second"}; !reflect.DeepEqual(shared, expected) {
+		t.Errorf("shared objects left are %v, expected %v", shared, expected)
+	}
+}
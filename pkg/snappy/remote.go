@@ -0,0 +1,395 @@
+package snappy
+
+import (
+	"io"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Basic consts for transfers
+const (
+	// Bytes per second
+	BytesPerSecond int = 1
+	// Kilobits per second
+	Kbps = BytesPerSecond * (1024 / 8)
+	// Megabits per second
+	Mbps = Kbps * 1024
+	// Gigabits per second
+	Gbps = Mbps * 1024
+	// Unlimited bandwidth
+	Unlimited = math.MaxInt64
+
+	SnapshotCompleted = "SNAPSHOT_COMPLETED"
+
+	// files smaller than this stay in the default storage class, archive
+	// classes bill a minimum object size and add per object overhead
+	smallFileSize = 128 * 1024
+)
+
+// storageClasses are the storage classes accepted for backups by the scheme of the destination,
+// S3 storage classes, GCS storage classes and Azure access tiers
+var storageClasses = map[string][]string{
+	"s3": {"STANDARD", "STANDARD_IA", "ONEZONE_IA", "INTELLIGENT_TIERING", "GLACIER_IR", "GLACIER", "DEEP_ARCHIVE"},
+	"gs": {"STANDARD", "NEARLINE", "COLDLINE", "ARCHIVE"},
+	"az": {"Hot", "Cool", "Cold", "Archive"},
+}
+
+// IsArchiveStorageClass reports whether objects in class must be restored before they can be read
+func IsArchiveStorageClass(class string) bool {
+	return class == "GLACIER" || class == "DEEP_ARCHIVE"
+}
+
+// Remote implements the snapshot layout used by backup and restore on top of a Storage backend
+type Remote struct {
+	name         string
+	storage      Storage
+	storageClass string
+}
+
+// NewRemote wraps a Storage backend
+func NewRemote(name string, storage Storage) *Remote {
+	return &Remote{name: name, storage: storage}
+}
+
+// OpenRemote creates the Storage backend described by config and wraps it
+func OpenRemote(config *StorageConfig) (*Remote, error) {
+	if err := validateStorageClass(config); err != nil {
+		return nil, err
+	}
+
+	storage, err := NewStorage(config)
+	if err != nil {
+		return nil, err
+	}
+	remote := NewRemote(config.Destination, storage)
+	remote.storageClass = config.StorageClass
+	return remote, nil
+}
+
+// validateStorageClass checks the storage class is supported by the backend of the destination
+func validateStorageClass(config *StorageConfig) error {
+	if config.StorageClass == "" {
+		return nil
+	}
+	u, err := url.Parse(config.Destination)
+	if err != nil {
+		return errors.Wrapf(err, "invalid destination [%s]", config.Destination)
+	}
+	classes, ok := storageClasses[u.Scheme]
+	if !ok {
+		return errors.New("storage classes are only supported on s3, gs and az destinations")
+	}
+	if !contains(classes, config.StorageClass) {
+		return errors.Errorf("unknown storage class [%s], expected one of %s", config.StorageClass, strings.Join(classes, ", "))
+	}
+	return nil
+}
+
+// Storage returns the backend this remote is reading and writing
+func (r *Remote) Storage() Storage {
+	return r.storage
+}
+
+// String returns the destination this remote was opened with
+func (r *Remote) String() string {
+	return r.name
+}
+
+// UploadFile uploads a local file and its metadata, encoding it on the way
+func (r *Remote) UploadFile(filename string, key string, metadata map[string]string, encoding Encoding) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// upload file
+	log.Debugf("uploading file [%s] -> [%s]", filename, key)
+	reader, err := encoding.Reader(DiskLimiter.Reader(f))
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	if err := r.storage.Put(key, NetworkLimiter.Reader(reader), r.putOptions(fi.Size(), metadata)); err != nil {
+		return errors.Wrapf(err, "error uploading %s", filename)
+	}
+	return nil
+}
+
+// putOptions applies the configured storage class to files that are large enough to benefit from it
+func (r *Remote) putOptions(size int64, metadata map[string]string) PutOptions {
+	opts := PutOptions{Metadata: metadata}
+	if size >= smallFileSize {
+		opts.StorageClass = r.storageClass
+	}
+	return opts
+}
+
+// DownloadFiles handles downloading concurrently multiple files from the bucket as quickly as possible
+// This method will check if existing files were already downloaded and skip those if necessary.
+// The keyring is only needed when files were encrypted.
+func (r *Remote) DownloadFiles(files []ManifestFile, directory string, keyring *Keyring) error {
+	var wg sync.WaitGroup
+	for _, file := range files {
+		// files can come from several snapshots when incremental backups are restored,
+		// or from the shared folder when they were deduplicated
+		splitPath := strings.SplitN(file.Path(), "/", 3)
+		trimPath := splitPath[len(splitPath)-1]
+		dirFolder := filepath.Dir(filepath.Join(directory, trimPath))
+
+		if _, err := os.Stat(dirFolder); err != nil {
+			log.Debugf("Creating directory: %s", dirFolder)
+			if err := os.MkdirAll(dirFolder, 0755); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		wg.Add(1)
+		go func(file ManifestFile) {
+			defer wg.Done()
+			if err := r.downloadManifestFile(file, filepath.Join(directory, trimPath), keyring); err != nil {
+				log.Fatal(err)
+			}
+		}(file)
+	}
+	wg.Wait()
+
+	return nil
+}
+
+// DownloadFile writes the object at key to localFile, skipping files that were already fully downloaded
+func (r *Remote) DownloadFile(key string, localFile string) error {
+	// check if this file already exists, to avoid re-downloading
+	if f, err := os.Stat(localFile); err == nil {
+		// file was found lets compare snapshot size with local size to make sure it was fully downloaded
+		info, err := r.storage.Head(key)
+		if err == nil && info.Size == f.Size() {
+			log.Debugf("file was already downloaded, skipping: %s", localFile)
+			return nil
+		}
+	}
+	return r.download(ManifestFile{Key: key}, localFile, nil)
+}
+
+// downloadManifestFile writes a file of a snapshot to localFile, decoding it when it was uploaded compressed or encrypted
+func (r *Remote) downloadManifestFile(file ManifestFile, localFile string, keyring *Keyring) error {
+	if file.Compression == "" && file.KeyID == "" {
+		return r.DownloadFile(file.ObjectKey(), localFile)
+	}
+
+	// encoded objects differ in size from the file, compare with the size recorded in the manifest
+	if f, err := os.Stat(localFile); err == nil && f.Size() == file.Size {
+		log.Debugf("file was already downloaded, skipping: %s", localFile)
+		return nil
+	}
+	return r.download(file, localFile, keyring)
+}
+
+// download streams the object of file to localFile, decoding it on the way
+func (r *Remote) download(file ManifestFile, localFile string, keyring *Keyring) error {
+	key := file.ObjectKey()
+	body, err := r.storage.Get(key)
+	if err != nil {
+		return errors.Wrapf(err, "error downloading %s", key)
+	}
+	defer body.Close()
+
+	reader, err := decodeReader(NetworkLimiter.Reader(body), file.Compression, file.KeyID, keyring)
+	if err != nil {
+		return errors.Wrapf(err, "error downloading %s", key)
+	}
+	defer reader.Close()
+
+	diskFile, err := os.Create(localFile)
+	if err != nil {
+		return err
+	}
+	defer diskFile.Close()
+
+	if _, err := io.Copy(diskFile, DiskLimiter.Reader(reader)); err != nil {
+		return errors.Wrapf(err, "error downloading %s", key)
+	}
+	log.Debugf("Downloaded file: %s", localFile)
+	return nil
+}
+
+// RestoreArchived requests a readable copy of every archived object in keys and
+// waits until all of them can be downloaded, checking again every interval
+func (r *Remote) RestoreArchived(keys []string, days int, tier string, interval time.Duration) error {
+	archiver, ok := r.storage.(Archiver)
+	if !ok {
+		return nil
+	}
+
+	pending := keys
+	for {
+		var waiting []string
+		for _, key := range pending {
+			ready, err := archiver.Restore(key, days, tier)
+			if err != nil {
+				return errors.Wrapf(err, "unable to restore archived object %s", key)
+			}
+			if !ready {
+				waiting = append(waiting, key)
+			}
+		}
+
+		if len(waiting) == 0 {
+			return nil
+		}
+		log.Infof("waiting for %d archived objects to be restored, checking again in %s", len(waiting), interval)
+		time.Sleep(interval)
+		pending = waiting
+	}
+}
+
+// IsSnapshotComplete checks if a previous uploaded snapshot was completely uploaded
+func (r *Remote) IsSnapshotComplete(path string) bool {
+	key := filepath.Join(path, SnapshotCompleted)
+	_, err := r.storage.Head(key)
+
+	return err == nil
+}
+
+// MarkSnapshotComplete marks a snapshot as completely uploaded
+func (r *Remote) MarkSnapshotComplete(prefix, snapshotID string) bool {
+	key := filepath.Join(prefix, snapshotID, SnapshotCompleted)
+	err := r.storage.Put(key, strings.NewReader(""), PutOptions{})
+
+	return err == nil
+}
+
+// IsClusterSnapshotComplete checks if every ring member completed a snapshot
+func (r *Remote) IsClusterSnapshotComplete(snapshotID string) bool {
+	return r.IsSnapshotComplete(filepath.Join(SnapshotFolderPrefix, snapshotID))
+}
+
+// MarkClusterSnapshotComplete writes the cluster completion marker once every node in members
+// completed the snapshot, it reports whether the cluster snapshot is complete
+func (r *Remote) MarkClusterSnapshotComplete(snapshotID string, members []string) (bool, error) {
+	for _, node := range members {
+		if !r.IsSnapshotComplete(filepath.Join(SnapshotFolderPrefix, snapshotID, node)) {
+			log.Debugf("node [%s] has not completed snapshot [%s] on [%s]", node, snapshotID, r)
+			return false, nil
+		}
+	}
+	if !r.MarkSnapshotComplete(SnapshotFolderPrefix, snapshotID) {
+		return false, errors.New("unable to write cluster completion marker")
+	}
+	return true, nil
+}
+
+// ringNodes finds the nodes that uploaded a snapshot for the ring members with the given host ids,
+// it returns the host ids of the members without a node snapshot in missing
+func (r *Remote) ringNodes(snapshotID string, hostIDs []string) (nodes []string, missing []string) {
+	uploaded := make(map[string]string)
+	for _, node := range r.ListNodes(snapshotID) {
+		manifest, err := r.ReadManifest(snapshotID, node)
+		if err != nil {
+			if err != ErrNotExist {
+				log.Warnf("unable to read manifest of node [%s] on [%s]: %v", node, r, err)
+			}
+			continue
+		}
+		if manifest.Node.HostID != "" {
+			uploaded[manifest.Node.HostID] = node
+		}
+	}
+
+	for _, hostID := range hostIDs {
+		if node, ok := uploaded[hostID]; ok {
+			nodes = append(nodes, node)
+		} else {
+			missing = append(missing, hostID)
+		}
+	}
+	return nodes, missing
+}
+
+// ListSnapshots returns the id of every snapshot and incremental backup on the remote
+func (r *Remote) ListSnapshots() ([]string, error) {
+	var snapshots []string
+
+	prefix := SnapshotFolderPrefix + "/"
+	listing, err := r.storage.List(prefix, "/")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list snapshots")
+	}
+
+	for _, obj := range listing.Prefixes {
+		snapshots = append(snapshots, strings.TrimSuffix(strings.TrimPrefix(obj, prefix), "/"))
+	}
+	return snapshots, nil
+}
+
+// ListNodes returns the nodes that uploaded files for a snapshot
+func (r *Remote) ListNodes(snapshotID string) []string {
+	var nodes []string
+
+	prefix := filepath.Join(SnapshotFolderPrefix, snapshotID) + "/"
+	listing, err := r.storage.List(prefix, "/")
+	if err != nil {
+		log.Fatalf("failed to list objects, %v", err)
+	}
+
+	for _, obj := range listing.Prefixes {
+		nodes = append(nodes, strings.TrimSuffix(strings.TrimPrefix(obj, prefix), "/"))
+	}
+
+	return nodes
+}
+
+// CopyFrom copies an object and its metadata from another remote, server side when the backends allow it.
+// Objects that already exist with the same size, and the same checksum when both carry one, are skipped
+// and reported as not copied.
+func (r *Remote) CopyFrom(src *Remote, obj ObjectInfo) (bool, error) {
+	// listings do not include metadata on every backend
+	if obj.Metadata == nil {
+		info, err := src.storage.Head(obj.Key)
+		if err != nil {
+			return false, err
+		}
+		obj.Metadata = info.Metadata
+	}
+
+	if existing, err := r.storage.Head(obj.Key); err == nil && existing.Size == obj.Size {
+		stored, expected := existing.Metadata[MetadataChecksum], obj.Metadata[MetadataChecksum]
+		if stored == "" || expected == "" || stored == expected {
+			log.Debugf("object already exists, skipping: %s", obj.Key)
+			return false, nil
+		}
+		log.Debugf("object exists with checksum %s instead of %s, copying it again: %s", stored, expected, obj.Key)
+	}
+
+	if copier, ok := r.storage.(Copier); ok {
+		copied, err := copier.Copy(src.storage, obj.Key, obj.Key, obj.Size, r.putOptions(obj.Size, obj.Metadata))
+		if copied || err != nil {
+			return copied, err
+		}
+	}
+
+	body, err := src.storage.Get(obj.Key)
+	if err != nil {
+		return false, err
+	}
+	defer body.Close()
+
+	if err := r.storage.Put(obj.Key, NetworkLimiter.Reader(body), r.putOptions(obj.Size, obj.Metadata)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
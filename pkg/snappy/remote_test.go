@@ -0,0 +1,58 @@
+package snappy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidateStorageClass(t *testing.T) {
+	tests := []struct {
+		destination  string
+		storageClass string
+		valid        bool
+	}{
+		{"file:///mnt/backups", "", true},
+		{"file:///mnt/backups", "STANDARD", false},
+		{"sftp://backup@localhost/srv/backups", "Cool", false},
+		{"s3://bucket/prefix", "GLACIER", true},
+		{"s3://bucket/prefix", "COLDLINE", false},
+		{"gs://bucket/prefix", "COLDLINE", true},
+		{"gs://bucket/prefix", "GLACIER", false},
+		{"az://account/container", "Archive", true},
+		{"az://account/container", "archive", false},
+	}
+	for _, tt := range tests {
+		err := validateStorageClass(&StorageConfig{Destination: tt.destination, StorageClass: tt.storageClass})
+		if (err == nil) != tt.valid {
+			t.Errorf("%s with storage class %q: valid is %t, expected %t (%v)", tt.destination, tt.storageClass, err == nil, tt.valid, err)
+		}
+	}
+}
+
+func TestRingNodes(t *testing.T) {
+	remote := testRemote(t)
+	for node, hostID := range map[string]string{"10.0.0.1": "host-1", "10.0.0.2": "host-2", "10.0.0.3": ""} {
+		manifest := &Manifest{SnapshotID: "s1", Node: ManifestNode{Address: node, HostID: hostID}}
+		if err := remote.WriteManifest(manifest); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		hostIDs []string
+		nodes   []string
+		missing []string
+	}{
+		{"every member uploaded", []string{"host-2", "host-1"}, []string{"10.0.0.2", "10.0.0.1"}, nil},
+		{"a member has not uploaded yet", []string{"host-1", "host-4"}, []string{"10.0.0.1"}, []string{"host-4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes, missing := remote.ringNodes("s1", tt.hostIDs)
+			if !reflect.DeepEqual(nodes, tt.nodes) || !reflect.DeepEqual(missing, tt.missing) {
+				t.Errorf("nodes are %v and missing %v, expected %v and %v", nodes, missing, tt.nodes, tt.missing)
+			}
+		})
+	}
+}
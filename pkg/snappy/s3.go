@@ -1,51 +1,52 @@
 package snappy
 
 import (
+	"context"
+	"fmt"
 	"io"
-	"math"
-	"os"
-	"path/filepath"
+	"net/url"
 	"strings"
-	"sync"
-	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
 	"github.com/aws/aws-sdk-go-v2/aws/external"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/s3manager"
-	"github.com/aybabtme/iocontrol"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
-// Basic consts for s3
 const (
-	// Bytes per second
-	BytesPerSecond int = 1
-	// Kilobits per second
-	Kbps = BytesPerSecond * (1024 / 8)
-	// Megabits per second
-	Mbps = Kbps * 1024
-	// Gigabits per second
-	Gbps = Mbps * 1024
-	// Unlimited bandwidth
-	Unlimited = math.MaxInt64
-
-	SnapshotCompleted = "SNAPSHOT_COMPLETED"
+	// defaultS3CompatibleRegion is used to sign requests to S3 compatible servers when no region is given
+	defaultS3CompatibleRegion = "us-east-1"
+	// objects larger than this must be copied with UploadPartCopy
+	s3MaxCopyObjectSize = 5 * 1024 * 1024 * 1024
+	s3CopyPartSize      = 512 * 1024 * 1024
 )
 
+// S3 stores backups in an AWS S3 bucket or on an S3 compatible server
 type S3 struct {
-	bucket     string
-	throttle   int
-	svc        *s3.S3
-	uploader   *s3manager.Uploader
-	downloader *s3manager.Downloader
+	bucket   string
+	prefix   string
+	endpoint string
+	svc      *s3.S3
+	uploader *s3manager.Uploader
+	// listV1 is set when the server does not implement ListObjectsV2
+	listV1 bool
 }
 
 type AWSConfig struct {
-	Region   string
-	Bucket   string
-	Throttle int
+	Region string
+	Bucket string
+	Prefix string
+	// Endpoint overrides the S3 endpoint, e.g. https://minio.local:9000 for MinIO, Ceph RGW or Wasabi
+	Endpoint string
+	// PathStyle addresses buckets as endpoint/bucket instead of bucket.endpoint
+	PathStyle bool
+	// CABundle is a PEM file with certificate authorities to trust for the endpoint
+	CABundle string
+	// InsecureTLS disables certificate verification of the endpoint
+	InsecureTLS bool
 }
 
 func NewS3(config *AWSConfig) (*S3, error) {
@@ -53,229 +54,332 @@ func NewS3(config *AWSConfig) (*S3, error) {
 	if err != nil {
 		log.Fatalln("unable to load SDK config,", err.Error())
 	}
-	cfg.Region = config.Region
+	if config.Region != "" {
+		cfg.Region = config.Region
+	}
+
+	if config.Endpoint != "" {
+		cfg.EndpointResolver = aws.ResolveWithEndpointURL(config.Endpoint)
+		if cfg.Region == "" {
+			cfg.Region = defaultS3CompatibleRegion
+		}
+	} else if cfg.Region == "" {
+		// look up where the bucket lives so that copies between regions need no extra flags
+		region, err := s3manager.GetBucketRegion(context.Background(), cfg, config.Bucket, defaultS3CompatibleRegion)
+		if err == nil {
+			cfg.Region = region
+		}
+	}
+
+	if config.CABundle != "" || config.InsecureTLS {
+		client, err := NewHTTPClient(config.CABundle, config.InsecureTLS)
+		if err != nil {
+			return nil, err
+		}
+		cfg.HTTPClient = client
+	}
 
 	svc := s3.New(cfg)
+	svc.ForcePathStyle = config.PathStyle
+
 	req := svc.HeadBucketRequest(&s3.HeadBucketInput{Bucket: &config.Bucket})
 	_, err = req.Send()
 	if err != nil {
 		log.Info(err)
+		if config.Endpoint != "" {
+			return nil, errors.Errorf("bucket [%s] not found on [%s] or you do not have sufficient permissions", config.Bucket, config.Endpoint)
+		}
 		return nil, errors.Errorf("bucket [%s] not found or you do not have sufficient permissions", config.Bucket)
 	}
 
 	return &S3{
-		bucket:     config.Bucket,
-		throttle:   config.Throttle,
-		svc:        svc,
-		uploader:   s3manager.NewUploader(cfg),
-		downloader: s3manager.NewDownloader(cfg),
+		bucket:   config.Bucket,
+		prefix:   config.Prefix,
+		endpoint: config.Endpoint,
+		svc:      svc,
+		uploader: s3manager.NewUploaderWithClient(svc),
 	}, nil
 }
 
-func (s *S3) UploadFile(filename string, key string) error {
-	var reader io.Reader
-
-	f, err := os.Open(filename)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	if s.throttle == 0 {
-		reader = f
-	} else {
-		maxBurst := 100 * time.Millisecond
-		readPerSec := s.throttle * Mbps
-		measured := iocontrol.NewMeasuredReader(f)
-		reader = iocontrol.ThrottledReader(measured, readPerSec, maxBurst)
-	}
-
-	// details of file to upload
+// Put uploads body to the bucket, using a multipart upload for large objects
+func (s *S3) Put(key string, body io.Reader, opts PutOptions) error {
 	params := &s3manager.UploadInput{
-		Bucket: aws.String(s.bucket),
-		Body:   reader,
-		Key:    aws.String(key),
+		Bucket:       aws.String(s.bucket),
+		Body:         body,
+		Key:          aws.String(joinKey(s.prefix, key)),
+		StorageClass: s3.StorageClass(opts.StorageClass),
+		Metadata:     opts.Metadata,
+	}
+	if tags := objectTags(opts.Metadata); tags != "" {
+		params.Tagging = aws.String(tags)
 	}
 
-	// upload file
-	log.Debugf("uploading file [%s] -> [%s]", filename, key)
-	_, err = s.uploader.Upload(params, func(u *s3manager.Uploader) {
+	_, err := s.uploader.Upload(params, func(u *s3manager.Uploader) {
 		u.MaxUploadParts = 10000       // set to maximum allowed by s3
 		u.PartSize = 128 * 1024 * 1024 // 128MB
 	})
-	if err != nil {
-		return errors.Wrapf(err, "error uploading %s", filename)
-	}
-	return nil
-}
-
-// DownloadFiles handles downloading concurrently multiple files from the bucket as quickly as possible
-// This method will check if existing files were already downloaded and skip those if necessary
-func (s *S3) DownloadFiles(snapshotPath string, keys []string, directory string) error {
-	var wg sync.WaitGroup
-	for _, key := range keys {
-		filePath := strings.TrimPrefix(key, snapshotPath)
-		splitPath := strings.Split(filePath, "/")
-		trimPath := strings.Join(splitPath[2:], "/")
-		dirFolder := filepath.Dir(filepath.Join(directory, trimPath))
-
-		if _, err := os.Stat(dirFolder); err != nil {
-			log.Debugf("Creating directory: %s", dirFolder)
-			if err := os.MkdirAll(dirFolder, 0755); err != nil {
-				log.Fatal(err)
-			}
-		}
-
-		wg.Add(1)
-		go func(key string) {
-			defer wg.Done()
-			localFile := filepath.Join(directory, trimPath)
-
-			// check if this file already exists, to avoid re-downloading
-			if f, err := os.Stat(localFile); err == nil {
-				// file was found lets compare snapshot size with local size to make sure it was fully downloaded
-				params := &s3.HeadObjectInput{
-					Bucket: aws.String(s.bucket),
-					Key:    aws.String(key),
-				}
-
-				req := s.svc.HeadObjectRequest(params)
-				result, err := req.Send()
-
-				if err == nil && *result.ContentLength == f.Size() {
-					log.Debugf("file was already downloaded, skipping: %s", localFile)
-					return
-				}
-			}
-
-			diskFile, err := os.Create(localFile)
-			defer diskFile.Close()
-
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			params := &s3.GetObjectInput{
-				Bucket: aws.String(s.bucket),
-				Key:    aws.String(key),
-			}
-
-			_, err = s.downloader.Download(diskFile, params)
-			if err != nil {
-				log.Fatal(err)
-			}
-			log.Debugf("Downloaded file: %s", filepath.Join(directory, trimPath))
-		}(key)
-	}
-	wg.Wait()
-
-	return nil
+	return err
 }
 
-// IsSnapshotComplete checks if a previous uploaded snapshot was completely uploaded
-func (s *S3) IsSnapshotComplete(path string) bool {
-	key := filepath.Join(path, SnapshotCompleted)
-	req := s.svc.HeadObjectRequest(&s3.HeadObjectInput{Bucket: &s.bucket, Key: aws.String(key)})
-	_, err := req.Send()
+// Get opens an object from the bucket for reading
+func (s *S3) Get(key string) (io.ReadCloser, error) {
+	params := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(joinKey(s.prefix, key)),
+	}
 
-	return err == nil
+	result, err := s.svc.GetObjectRequest(params).Send()
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	return result.Body, nil
 }
 
-// MarkSnapshotComplete marks a snapshot as completely uploaded
-func (s *S3) MarkSnapshotComplete(prefix, snapshotID string) bool {
-	key := filepath.Join(prefix, snapshotID, SnapshotCompleted)
-
-	params := &s3manager.UploadInput{
+// Head returns the size, modification time and metadata of an object in the bucket
+func (s *S3) Head(key string) (*ObjectInfo, error) {
+	params := &s3.HeadObjectInput{
 		Bucket: aws.String(s.bucket),
-		Body:   strings.NewReader(""),
-		Key:    aws.String(key),
+		Key:    aws.String(joinKey(s.prefix, key)),
 	}
 
-	// upload file
-	_, err := s.uploader.Upload(params)
+	result, err := s.svc.HeadObjectRequest(params).Send()
+	if err != nil {
+		return nil, s3Error(err)
+	}
 
-	return err == nil
+	info := &ObjectInfo{Key: key, Metadata: normalizeMetadata(result.Metadata)}
+	if result.ContentLength != nil {
+		info.Size = *result.ContentLength
+	}
+	if result.LastModified != nil {
+		info.LastModified = *result.LastModified
+	}
+	return info, nil
 }
 
-// ListKeyspaces returns a set of keyspaces found on the bucket
-func (s *S3) ListKeyspaces(path string) []string {
-	var keyspaces []string
+// List pages through all objects in the bucket under prefix
+func (s *S3) List(prefix string, delimiter string) (*Listing, error) {
+	if !s.listV1 {
+		listing, err := s.listObjectsV2(prefix, delimiter)
+		if !isNotImplemented(err) {
+			return listing, err
+		}
+		// older S3 compatible servers only implement the original listing api
+		log.Debug("ListObjectsV2 is not implemented by the server, falling back to ListObjects")
+		s.listV1 = true
+	}
+	return s.listObjects(prefix, delimiter)
+}
+
+func (s *S3) listObjectsV2(prefix string, delimiter string) (*Listing, error) {
+	var listing = &Listing{}
 
 	params := &s3.ListObjectsV2Input{
-		Bucket:    aws.String(s.bucket),
-		Prefix:    aws.String(path),
-		Delimiter: aws.String("/"),
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(joinKey(s.prefix, prefix)),
+	}
+	if delimiter != "" {
+		params.Delimiter = aws.String(delimiter)
 	}
-	req := s.svc.ListObjectsV2Request(params)
 
+	req := s.svc.ListObjectsV2Request(params)
 	p := req.Paginate()
 	for p.Next() {
 		page := p.CurrentPage()
-		for _, obj := range page.CommonPrefixes {
-			keyspace := strings.TrimSuffix(strings.TrimPrefix(*obj.Prefix, *page.Prefix), "/")
-			// do not include system_* keyspaces
-			if !strings.HasPrefix(keyspace, "system") {
-				keyspaces = append(keyspaces, keyspace)
-			}
-		}
+		s.appendPage(listing, page.CommonPrefixes, page.Contents)
 	}
 
 	if err := p.Err(); err != nil {
-		log.Fatalf("failed to list objects, %v", err)
+		return nil, errors.Wrap(err, "failed to list objects")
 	}
-
-	return keyspaces
+	return listing, nil
 }
 
-// ListTables returns a set of tables found on the bucket from a keyspace
-func (s *S3) ListTables(path string, keyspace string) []string {
-	var tables []string
+func (s *S3) listObjects(prefix string, delimiter string) (*Listing, error) {
+	var listing = &Listing{}
 
-	params := &s3.ListObjectsV2Input{
-		Bucket:    aws.String(s.bucket),
-		Prefix:    aws.String(filepath.Join(path, keyspace) + "/"),
-		Delimiter: aws.String("/"),
+	params := &s3.ListObjectsInput{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(joinKey(s.prefix, prefix)),
 	}
-	req := s.svc.ListObjectsV2Request(params)
+	if delimiter != "" {
+		params.Delimiter = aws.String(delimiter)
+	}
+
+	req := s.svc.ListObjectsRequest(params)
 	p := req.Paginate()
 	for p.Next() {
 		page := p.CurrentPage()
-		for _, obj := range page.CommonPrefixes {
-			table := strings.TrimSuffix(strings.TrimPrefix(*obj.Prefix, *page.Prefix), "/")
-			tables = append(tables, table)
-		}
+		s.appendPage(listing, page.CommonPrefixes, page.Contents)
 	}
 
 	if err := p.Err(); err != nil {
-		log.Fatalf("failed to list objects, %v", err)
+		return nil, errors.Wrap(err, "failed to list objects")
 	}
+	return listing, nil
+}
 
-	return tables
+// appendPage adds a page of listing results to listing, relative to the backend prefix
+func (s *S3) appendPage(listing *Listing, prefixes []s3.CommonPrefix, contents []s3.Object) {
+	for _, obj := range prefixes {
+		listing.Prefixes = append(listing.Prefixes, trimKey(s.prefix, *obj.Prefix))
+	}
+	for _, obj := range contents {
+		info := ObjectInfo{Key: trimKey(s.prefix, *obj.Key)}
+		if obj.Size != nil {
+			info.Size = *obj.Size
+		}
+		if obj.LastModified != nil {
+			info.LastModified = *obj.LastModified
+		}
+		listing.Objects = append(listing.Objects, info)
+	}
 }
 
-func (s *S3) ListSnapshotFiles(path string, keyspace string, table string, uuid string) []string {
-	var files []string
-	var tableName = table + "-" + uuid
+// Delete removes an object from the bucket
+func (s *S3) Delete(key string) error {
+	params := &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(joinKey(s.prefix, key)),
+	}
 
-	relPath := filepath.Join(path, keyspace, tableName)
+	_, err := s.svc.DeleteObjectRequest(params).Send()
+	return s3Error(err)
+}
 
-	log.Debugf("s3 path: %s", relPath)
+// Copy copies an object from another bucket on the same S3 service without
+// downloading it, returning false when src is not reachable server side
+func (s *S3) Copy(src Storage, srcKey, dstKey string, size int64, opts PutOptions) (bool, error) {
+	from, ok := src.(*S3)
+	if !ok || from.endpoint != s.endpoint {
+		return false, nil
+	}
 
-	params := &s3.ListObjectsV2Input{
-		Bucket: aws.String(s.bucket),
-		Prefix: aws.String(relPath),
+	var source []string
+	for _, segment := range strings.Split(from.bucket+"/"+joinKey(from.prefix, srcKey), "/") {
+		source = append(source, url.PathEscape(segment))
 	}
-	req := s.svc.ListObjectsV2Request(params)
-	p := req.Paginate()
-	for p.Next() {
-		page := p.CurrentPage()
-		for _, obj := range page.Contents {
-			files = append(files, *obj.Key)
+	copySource := strings.Join(source, "/")
+	key := joinKey(s.prefix, dstKey)
+
+	if size <= s3MaxCopyObjectSize {
+		params := &s3.CopyObjectInput{
+			Bucket:       aws.String(s.bucket),
+			CopySource:   aws.String(copySource),
+			Key:          aws.String(key),
+			StorageClass: s3.StorageClass(opts.StorageClass),
 		}
+		_, err := s.svc.CopyObjectRequest(params).Send()
+		return true, s3Error(err)
 	}
+	return true, s.copyMultipart(copySource, key, size, opts)
+}
 
-	if err := p.Err(); err != nil {
-		log.Fatalf("failed to list objects, %v", err)
+// copyMultipart copies objects larger than 5GB in parts with UploadPartCopy
+func (s *S3) copyMultipart(copySource, key string, size int64, opts PutOptions) error {
+	params := &s3.CreateMultipartUploadInput{
+		Bucket:       aws.String(s.bucket),
+		Key:          aws.String(key),
+		StorageClass: s3.StorageClass(opts.StorageClass),
+		// parts copied with UploadPartCopy do not carry the source metadata
+		Metadata: opts.Metadata,
+	}
+	if tags := objectTags(opts.Metadata); tags != "" {
+		params.Tagging = aws.String(tags)
+	}
+	upload, err := s.svc.CreateMultipartUploadRequest(params).Send()
+	if err != nil {
+		return err
 	}
 
-	return files
+	var parts []s3.CompletedPart
+	for offset, part := int64(0), int64(1); offset < size; offset, part = offset+s3CopyPartSize, part+1 {
+		end := offset + s3CopyPartSize - 1
+		if end >= size {
+			end = size - 1
+		}
+
+		result, err := s.svc.UploadPartCopyRequest(&s3.UploadPartCopyInput{
+			Bucket:          aws.String(s.bucket),
+			Key:             aws.String(key),
+			CopySource:      aws.String(copySource),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, end)),
+			PartNumber:      aws.Int64(part),
+			UploadId:        upload.UploadId,
+		}).Send()
+		if err != nil {
+			s.svc.AbortMultipartUploadRequest(&s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(s.bucket),
+				Key:      aws.String(key),
+				UploadId: upload.UploadId,
+			}).Send()
+			return errors.Wrapf(err, "error copying part %d of %s", part, key)
+		}
+		parts = append(parts, s3.CompletedPart{ETag: result.CopyPartResult.ETag, PartNumber: aws.Int64(part)})
+	}
+
+	_, err = s.svc.CompleteMultipartUploadRequest(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(key),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	}).Send()
+	return err
+}
+
+// Restore issues a RestoreObject request for objects in the GLACIER and DEEP_ARCHIVE
+// classes and reports whether the object can be downloaded now
+func (s *S3) Restore(key string, days int, tier string) (bool, error) {
+	head, err := s.svc.HeadObjectRequest(&s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(joinKey(s.prefix, key)),
+	}).Send()
+	if err != nil {
+		return false, s3Error(err)
+	}
+
+	if !IsArchiveStorageClass(string(head.StorageClass)) {
+		return true, nil
+	}
+	if head.Restore != nil {
+		// x-amz-restore is ongoing-request="true" while the restore is running and
+		// ongoing-request="false", expiry-date="..." once the copy is available
+		return strings.Contains(*head.Restore, `ongoing-request="false"`), nil
+	}
+
+	log.Debugf("requesting restore of archived object [%s] from %s", key, head.StorageClass)
+	_, err = s.svc.RestoreObjectRequest(&s3.RestoreObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(joinKey(s.prefix, key)),
+		RestoreRequest: &s3.RestoreRequest{
+			Days:                 aws.Int64(int64(days)),
+			GlacierJobParameters: &s3.GlacierJobParameters{Tier: s3.Tier(tier)},
+		},
+	}).Send()
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "RestoreAlreadyInProgress" {
+		return false, nil
+	}
+	return false, err
+}
+
+// s3Error maps missing objects to ErrNotExist
+func s3Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == 404 {
+		return ErrNotExist
+	}
+	if awsErr, ok := err.(awserr.Error); ok && strings.Contains(awsErr.Code(), "NoSuchKey") {
+		return ErrNotExist
+	}
+	return err
+}
+
+// isNotImplemented reports whether the server rejected an api call it does not support
+func isNotImplemented(err error) bool {
+	if awsErr, ok := errors.Cause(err).(awserr.Error); ok {
+		return awsErr.Code() == "NotImplemented"
+	}
+	return false
 }
@@ -0,0 +1,232 @@
+package snappy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// SchemaFilename holds the schema of the cluster in every node snapshot, Cassandra also
+// writes a schema.cql with the definition of the table in every table snapshot directory
+const SchemaFilename = "schema.cql"
+
+var (
+	createStatement     = regexp.MustCompile(`(?i)\bCREATE\s+(KEYSPACE|TABLE|TYPE|FUNCTION|AGGREGATE|CUSTOM\s+INDEX|INDEX|MATERIALIZED\s+VIEW)\s+(IF\s+NOT\s+EXISTS\s+)?`)
+	keyspaceReplication = regexp.MustCompile(`(?is)(CREATE\s+KEYSPACE\s+(?:IF\s+NOT\s+EXISTS\s+)?(\S+)\s+WITH\s+replication\s*=\s*)(\{[^}]*\})`)
+	// replicationKey matches a quoted key of a replication map, quotes in the key are doubled
+	replicationKey = regexp.MustCompile(`'((?:[^']|'')*)'(\s*:)`)
+)
+
+// SchemaOptions controls how the schema of a snapshot is rewritten for the destination cluster
+type SchemaOptions struct {
+	// Replication replaces the replication of every keyspace, e.g. {'class': 'NetworkTopologyStrategy', 'dc1': 3}
+	Replication string
+	// RenameDatacenters maps datacenter names of the source cluster to the destination cluster
+	RenameDatacenters map[string]string
+	// Keyring decrypts the schema of encrypted snapshots
+	Keyring *Keyring
+}
+
+// schemaKey returns the key of the schema of a node snapshot
+func schemaKey(snapshotID, node string) string {
+	return filepath.Join(SnapshotFolderPrefix, snapshotID, node, SchemaFilename)
+}
+
+// captureSchema describes the schema of the cluster, failures are logged and leave the snapshot
+// with only the table definitions Cassandra writes into the snapshot directories
+func captureSchema(cassandra *Cassandra) []byte {
+	schema, err := cassandra.DescribeSchema()
+	if err != nil {
+		log.Warnf("unable to capture the keyspace definitions, only table definitions will be backed up: %v", err)
+		return nil
+	}
+	return []byte(schema)
+}
+
+// WriteSchema uploads the schema captured with a node snapshot, encrypted when a keyring is given
+func (r *Remote) WriteSchema(snapshotID, node string, schema []byte, keyring *Keyring) error {
+	var (
+		key              = schemaKey(snapshotID, node)
+		reader io.Reader = bytes.NewReader(schema)
+	)
+	if keyring != nil {
+		encrypted, err := keyring.Encrypt(reader)
+		if err != nil {
+			return err
+		}
+		key, reader = key+EncryptedExtension, encrypted
+	}
+	if err := r.storage.Put(key, reader, PutOptions{}); err != nil {
+		return errors.Wrapf(err, "error uploading %s", key)
+	}
+	return nil
+}
+
+// SnapshotSchema returns the CQL that creates the keyspaces and tables of a snapshot, rewritten for
+// the destination cluster. Every statement is made idempotent so it can be applied to a cluster
+// where part of the schema already exists.
+func SnapshotSchema(config *StorageConfig, snapshotID, node string, options *SchemaOptions) (string, error) {
+	remote, err := OpenRemote(config)
+	if err != nil {
+		return "", err
+	}
+
+	if node == "" {
+		nodes := remote.ListNodes(snapshotID)
+		if len(nodes) == 0 {
+			return "", errors.Errorf("snapshot [%s] not found on [%s]", snapshotID, remote)
+		}
+		node = nodes[0]
+	}
+
+	schema, err := remote.readSchema(snapshotID, node, options.Keyring)
+	if err == ErrNotExist {
+		schema, err = remote.tableSchemas(snapshotID, node, options)
+	}
+	if err != nil {
+		return "", err
+	}
+	return rewriteSchema(schema, options), nil
+}
+
+// readSchema downloads the schema captured with a node snapshot
+func (r *Remote) readSchema(snapshotID, node string, keyring *Keyring) (string, error) {
+	file := ManifestFile{Key: schemaKey(snapshotID, node)}
+	if _, err := r.storage.Head(file.Key); err == ErrNotExist {
+		if _, err := r.storage.Head(file.Key + EncryptedExtension); err != nil {
+			return "", err
+		}
+		file.Object, file.KeyID = file.Key+EncryptedExtension, "unknown"
+	}
+
+	data, err := r.readFile(file, keyring)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// tableSchemas assembles a schema from the table definitions in the snapshot directories, for
+// snapshots taken without keyspace definitions. Keyspaces are created with the given replication.
+func (r *Remote) tableSchemas(snapshotID, node string, options *SchemaOptions) (string, error) {
+	manifests, err := r.LoadChain(snapshotID, node)
+	if err != nil {
+		return "", err
+	}
+	manifest := mergeManifests(manifests)
+
+	var (
+		b         strings.Builder
+		keyspaces []string
+		tables    = manifest.Tables()
+	)
+	for keyspace := range tables {
+		if !strings.HasPrefix(keyspace, "system") {
+			keyspaces = append(keyspaces, keyspace)
+		}
+	}
+	sort.Strings(keyspaces)
+	if len(keyspaces) > 0 && options.Replication == "" {
+		return "", errors.Errorf("snapshot [%s] has no keyspace definitions, use --replication to create them", snapshotID)
+	}
+
+	for _, keyspace := range keyspaces {
+		b.WriteString("CREATE KEYSPACE " + keyspace + " WITH replication = " + options.Replication + ";\n\n")
+		for _, table := range tables[keyspace] {
+			name, uuid := Split(table, "-")
+			for _, file := range manifest.TableFiles(keyspace, name, uuid) {
+				if file.Component != SchemaFilename {
+					continue
+				}
+				data, err := r.readFile(file, options.Keyring)
+				if err != nil {
+					return "", err
+				}
+				b.Write(data)
+				b.WriteString("\n")
+			}
+		}
+	}
+	return b.String(), nil
+}
+
+// readFile downloads a small file of a snapshot into memory
+func (r *Remote) readFile(file ManifestFile, keyring *Keyring) ([]byte, error) {
+	body, err := r.storage.Get(file.ObjectKey())
+	if err != nil {
+		return nil, errors.Wrapf(err, "error downloading %s", file.ObjectKey())
+	}
+	defer body.Close()
+
+	reader, err := decodeReader(body, file.Compression, file.KeyID, keyring)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// rewriteSchema makes every create statement idempotent and applies the replication options.
+// CREATE OR REPLACE of functions and aggregates is already idempotent and left as is.
+func rewriteSchema(schema string, options *SchemaOptions) string {
+	schema = createStatement.ReplaceAllStringFunc(schema, func(statement string) string {
+		m := createStatement.FindStringSubmatch(statement)
+		return "CREATE " + m[1] + " IF NOT EXISTS "
+	})
+
+	return keyspaceReplication.ReplaceAllStringFunc(schema, func(statement string) string {
+		m := keyspaceReplication.FindStringSubmatch(statement)
+		replication := m[3]
+		if options.Replication != "" {
+			replication = options.Replication
+		}
+		return m[1] + renameDatacenters(replication, options.RenameDatacenters)
+	})
+}
+
+// renameDatacenters renames the datacenter keys of a replication map. Every key is renamed
+// at most once, so mappings that swap or chain datacenter names apply as given.
+func renameDatacenters(replication string, renames map[string]string) string {
+	if len(renames) == 0 {
+		return replication
+	}
+	return replicationKey.ReplaceAllStringFunc(replication, func(key string) string {
+		m := replicationKey.FindStringSubmatch(key)
+		to, ok := renames[strings.Replace(m[1], "''", "'", -1)]
+		if !ok {
+			return key
+		}
+		return "'" + strings.Replace(to, "'", "''", -1) + "'" + m[2]
+	})
+}
+
+// ApplySchema runs the CQL of a schema against the local node with cqlsh
+func ApplySchema(schema string) error {
+	f, err := ioutil.TempFile("", "snappy-schema-*.cql")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.WriteString(schema); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	output, err := NewCassandra().CQL("-f", f.Name())
+	if output != "" {
+		log.Info(strings.TrimSpace(output))
+	}
+	return err
+}
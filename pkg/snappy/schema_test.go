@@ -0,0 +1,83 @@
+package snappy
+
+import "testing"
+
+func TestRewriteSchema(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string
+		options SchemaOptions
+		want    string
+	}{
+		{
+			name:   "create statements become idempotent",
+			schema: "CREATE TABLE ks1.t1 (id int PRIMARY KEY);\ncreate type ks1.address (street text);\nCREATE INDEX t1_idx ON ks1.t1 (v);",
+			want:   "CREATE TABLE IF NOT EXISTS ks1.t1 (id int PRIMARY KEY);\nCREATE type IF NOT EXISTS ks1.address (street text);\nCREATE INDEX IF NOT EXISTS t1_idx ON ks1.t1 (v);",
+		},
+		{
+			name:   "existing if not exists is not repeated",
+			schema: "CREATE TABLE IF NOT EXISTS ks1.t1 (id int PRIMARY KEY);",
+			want:   "CREATE TABLE IF NOT EXISTS ks1.t1 (id int PRIMARY KEY);",
+		},
+		{
+			name:   "materialized views and custom indexes",
+			schema: "CREATE MATERIALIZED VIEW ks1.v1 AS SELECT * FROM ks1.t1;\nCREATE CUSTOM INDEX t1_sasi ON ks1.t1 (v) USING 'SASIIndex';",
+			want:   "CREATE MATERIALIZED VIEW IF NOT EXISTS ks1.v1 AS SELECT * FROM ks1.t1;\nCREATE CUSTOM INDEX IF NOT EXISTS t1_sasi ON ks1.t1 (v) USING 'SASIIndex';",
+		},
+		{
+			name:   "replication is kept without options",
+			schema: "CREATE KEYSPACE ks1 WITH replication = {'class': 'NetworkTopologyStrategy', 'dc1': '3'} AND durable_writes = true;",
+			want:   "CREATE KEYSPACE IF NOT EXISTS ks1 WITH replication = {'class': 'NetworkTopologyStrategy', 'dc1': '3'} AND durable_writes = true;",
+		},
+		{
+			name:    "replication is replaced",
+			schema:  "CREATE KEYSPACE ks1 WITH replication = {'class': 'SimpleStrategy', 'replication_factor': '1'};",
+			options: SchemaOptions{Replication: "{'class': 'NetworkTopologyStrategy', 'dc1': 3}"},
+			want:    "CREATE KEYSPACE IF NOT EXISTS ks1 WITH replication = {'class': 'NetworkTopologyStrategy', 'dc1': 3};",
+		},
+		{
+			name: "datacenters are renamed in every keyspace",
+			schema: "CREATE KEYSPACE ks1 WITH replication = {'class': 'NetworkTopologyStrategy', 'us-east': '3', 'eu': '2'};\n" +
+				"CREATE KEYSPACE ks2 WITH\n  replication = {'class': 'NetworkTopologyStrategy', 'us-east': '1'};\n" +
+				"CREATE TABLE ks1.t1 (dc text PRIMARY KEY) WITH comment = 'us-east';",
+			options: SchemaOptions{RenameDatacenters: map[string]string{"us-east": "us-west"}},
+			want: "CREATE KEYSPACE IF NOT EXISTS ks1 WITH replication = {'class': 'NetworkTopologyStrategy', 'us-west': '3', 'eu': '2'};\n" +
+				"CREATE KEYSPACE IF NOT EXISTS ks2 WITH\n  replication = {'class': 'NetworkTopologyStrategy', 'us-west': '1'};\n" +
+				"CREATE TABLE IF NOT EXISTS ks1.t1 (dc text PRIMARY KEY) WITH comment = 'us-east';",
+		},
+		{
+			name: "functions and aggregates",
+			schema: "CREATE FUNCTION ks1.plus(a int, b int) CALLED ON NULL INPUT RETURNS int LANGUAGE java AS 'return a + b;';\n" +
+				"CREATE AGGREGATE ks1.total(int) SFUNC plus STYPE int INITCOND 0;\n" +
+				"CREATE OR REPLACE FUNCTION ks1.minus(a int, b int) CALLED ON NULL INPUT RETURNS int LANGUAGE java AS 'return a - b;';",
+			want: "CREATE FUNCTION IF NOT EXISTS ks1.plus(a int, b int) CALLED ON NULL INPUT RETURNS int LANGUAGE java AS 'return a + b;';\n" +
+				"CREATE AGGREGATE IF NOT EXISTS ks1.total(int) SFUNC plus STYPE int INITCOND 0;\n" +
+				"CREATE OR REPLACE FUNCTION ks1.minus(a int, b int) CALLED ON NULL INPUT RETURNS int LANGUAGE java AS 'return a - b;';",
+		},
+		{
+			name:    "datacenters are swapped",
+			schema:  "CREATE KEYSPACE ks1 WITH replication = {'class': 'NetworkTopologyStrategy', 'dc1': '3', 'dc2': '1'};",
+			options: SchemaOptions{RenameDatacenters: map[string]string{"dc1": "dc2", "dc2": "dc1"}},
+			want:    "CREATE KEYSPACE IF NOT EXISTS ks1 WITH replication = {'class': 'NetworkTopologyStrategy', 'dc2': '3', 'dc1': '1'};",
+		},
+		{
+			name:    "chained renames apply once",
+			schema:  "CREATE KEYSPACE ks1 WITH replication = {'class': 'NetworkTopologyStrategy', 'dc1': '3', 'dc2': '1'};",
+			options: SchemaOptions{RenameDatacenters: map[string]string{"dc1": "dc2", "dc2": "dc3"}},
+			want:    "CREATE KEYSPACE IF NOT EXISTS ks1 WITH replication = {'class': 'NetworkTopologyStrategy', 'dc2': '3', 'dc3': '1'};",
+		},
+		{
+			name:    "only datacenter keys are renamed",
+			schema:  "CREATE KEYSPACE ks1 WITH replication = {'class': 'NetworkTopologyStrategy', 'NetworkTopologyStrategy' : '3'};",
+			options: SchemaOptions{RenameDatacenters: map[string]string{"NetworkTopologyStrategy": "dc1"}},
+			want:    "CREATE KEYSPACE IF NOT EXISTS ks1 WITH replication = {'class': 'NetworkTopologyStrategy', 'dc1' : '3'};",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rewriteSchema(tt.schema, &tt.options); got != tt.want {
+				t.Errorf("rewritten schema is\n%s\nexpected\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,315 @@
+package snappy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	sftpDefaultPort = 22
+	// sftpTempAttempts is how many random temporary file names are tried before an upload fails
+	sftpTempAttempts = 10
+	// sftpTempFlags create a temporary file only if no other upload uses its name
+	sftpTempFlags = os.O_WRONLY | os.O_CREATE | os.O_EXCL
+)
+
+// defaultSSHKeys are tried in order when no private key is configured
+var defaultSSHKeys = []string{"~/.ssh/id_ed25519", "~/.ssh/id_ecdsa", "~/.ssh/id_rsa"}
+
+// SFTP stores backups on a remote host over SFTP, using the same key layout as the object store backends
+type SFTP struct {
+	root   string
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+// SFTPConfig holds the settings needed to reach an SFTP host
+type SFTPConfig struct {
+	User string
+	Host string
+	Port int
+	// Root is the directory on the remote host that backups are written to
+	Root string
+	// KeyFile is a private key, the default keys in ~/.ssh are tried when empty
+	KeyFile string
+	// KnownHostsFile is used to verify the host key, defaults to ~/.ssh/known_hosts
+	KnownHostsFile string
+	// Concurrency is the number of requests in flight per file transfer
+	Concurrency int
+}
+
+func NewSFTP(config *SFTPConfig) (*SFTP, error) {
+	signer, err := loadSSHKey(config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	knownHostsFile := config.KnownHostsFile
+	if knownHostsFile == "" {
+		knownHostsFile = "~/.ssh/known_hosts"
+	}
+	knownHostsFile, err = homedir.Expand(knownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to load known hosts [%s]", knownHostsFile)
+	}
+
+	user := config.User
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	port := config.Port
+	if port == 0 {
+		port = sftpDefaultPort
+	}
+	addr := net.JoinHostPort(config.Host, strconv.Itoa(port))
+
+	conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to connect to [%s]", addr)
+	}
+
+	concurrency := config.Concurrency
+	if concurrency == 0 {
+		concurrency = 64
+	}
+	client, err := sftp.NewClient(conn,
+		sftp.UseConcurrentReads(true),
+		sftp.UseConcurrentWrites(true),
+		sftp.MaxConcurrentRequestsPerFile(concurrency),
+	)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "unable to start sftp session on [%s]", addr)
+	}
+
+	root := config.Root
+	if root == "" {
+		root = "."
+	}
+	fi, err := client.Stat(root)
+	if err != nil || !fi.IsDir() {
+		client.Close()
+		conn.Close()
+		return nil, errors.Errorf("backup directory [%s] not found on [%s]", root, addr)
+	}
+
+	return &SFTP{root: root, conn: conn, client: client}, nil
+}
+
+// loadSSHKey parses the configured private key or the first default key found
+func loadSSHKey(keyFile string) (ssh.Signer, error) {
+	candidates := defaultSSHKeys
+	if keyFile != "" {
+		candidates = []string{keyFile}
+	}
+
+	for _, candidate := range candidates {
+		filename, err := homedir.Expand(candidate)
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadFile(filename)
+		if os.IsNotExist(err) && keyFile == "" {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read private key [%s]", filename)
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to parse private key [%s]", filename)
+		}
+		return signer, nil
+	}
+	return nil, errors.New("no private key found, set one with --sftp-key")
+}
+
+func (s *SFTP) path(key string) string {
+	return path.Join(s.root, key)
+}
+
+// Put writes body to a temporary file next to key and renames it into place once the transfer completed
+func (s *SFTP) Put(key string, body io.Reader, opts PutOptions) error {
+	filename := s.path(key)
+	if err := s.client.MkdirAll(path.Dir(filename)); err != nil {
+		return err
+	}
+
+	tmp, tmpName, err := s.createTemp(path.Dir(filename))
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		s.client.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		s.client.Remove(tmpName)
+		return err
+	}
+
+	if err := s.client.PosixRename(tmpName, filename); err != nil {
+		// servers without the posix-rename extension refuse to overwrite
+		s.client.Remove(filename)
+		if err := s.client.Rename(tmpName, filename); err != nil {
+			s.client.Remove(tmpName)
+			return err
+		}
+	}
+	return nil
+}
+
+// createTemp creates a new temporary file in dir. Uploads to the same directory run in parallel,
+// so the file is created exclusively under a random name and another name is tried if it is taken.
+func (s *SFTP) createTemp(dir string) (*sftp.File, string, error) {
+	suffix := make([]byte, 8)
+	for attempt := 0; attempt < sftpTempAttempts; attempt++ {
+		if _, err := rand.Read(suffix); err != nil {
+			return nil, "", err
+		}
+		name := path.Join(dir, tempFilePrefix+hex.EncodeToString(suffix))
+		file, err := s.client.OpenFile(name, sftpTempFlags)
+		if err == nil {
+			return file, name, nil
+		}
+		// OpenSSH reports an existing file as a generic failure, only retry when the name is taken
+		if _, statErr := s.client.Lstat(name); statErr != nil {
+			return nil, "", err
+		}
+	}
+	return nil, "", errors.Errorf("unable to create a temporary file in %s", dir)
+}
+
+// Get opens the remote file at key for reading
+func (s *SFTP) Get(key string) (io.ReadCloser, error) {
+	file, err := s.client.Open(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotExist
+	}
+	return file, err
+}
+
+// Head returns the size and modification time of the remote file at key
+func (s *SFTP) Head(key string) (*ObjectInfo, error) {
+	fi, err := s.client.Stat(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, ErrNotExist
+	}
+	return &ObjectInfo{Key: key, Size: fi.Size(), LastModified: fi.ModTime()}, nil
+}
+
+// List walks the remote directory holding prefix and returns the matching files
+func (s *SFTP) List(prefix string, delimiter string) (*Listing, error) {
+	// walking would cost a round trip per directory of the whole subtree
+	if delimiter == "/" {
+		return dirListing(prefix, func(dir string) ([]os.FileInfo, error) { return s.client.ReadDir(s.path(dir)) })
+	}
+
+	var (
+		listing  = &Listing{}
+		prefixes = make(map[string]bool)
+	)
+
+	dir := s.root
+	if idx := strings.LastIndex(prefix, "/"); idx >= 0 {
+		dir = s.path(prefix[:idx])
+	}
+
+	walker := s.client.Walk(dir)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, errors.Wrap(err, "failed to list files")
+		}
+
+		info := walker.Stat()
+		if info.IsDir() || strings.HasPrefix(info.Name(), tempFilePrefix) {
+			continue
+		}
+
+		rel, err := filepath.Rel(s.root, walker.Path())
+		if err != nil {
+			return nil, err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		if delimiter != "" {
+			rest := strings.TrimPrefix(key, prefix)
+			if idx := strings.Index(rest, delimiter); idx >= 0 {
+				prefixes[prefix+rest[:idx+len(delimiter)]] = true
+				continue
+			}
+		}
+		listing.Objects = append(listing.Objects, ObjectInfo{Key: key, Size: info.Size(), LastModified: info.ModTime()})
+	}
+
+	for p := range prefixes {
+		listing.Prefixes = append(listing.Prefixes, p)
+	}
+	sort.Strings(listing.Prefixes)
+	return listing, nil
+}
+
+// Delete removes the remote file at key and any directories left empty by it
+func (s *SFTP) Delete(key string) error {
+	filename := s.path(key)
+	if err := s.client.Remove(filename); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	root := path.Clean(s.root)
+	for dir := path.Dir(filename); dir != root && dir != "." && dir != "/"; dir = path.Dir(dir) {
+		// directories that still have entries are refused by the server
+		if err := s.client.RemoveDirectory(dir); err != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// Close ends the sftp session and the underlying ssh connection
+func (s *SFTP) Close() error {
+	s.client.Close()
+	return s.conn.Close()
+}
@@ -0,0 +1,105 @@
+package snappy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+// pipeConn joins the read side of one pipe and the write side of another into a connection
+type pipeConn struct {
+	io.Reader
+	io.WriteCloser
+}
+
+// testSFTP connects an SFTP backend to an in process server rooted at a temporary directory
+func testSFTP(t *testing.T) (*SFTP, string) {
+	root := t.TempDir()
+	serverReader, clientWriter := io.Pipe()
+	clientReader, serverWriter := io.Pipe()
+
+	server, err := sftp.NewServer(pipeConn{serverReader, serverWriter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+
+	client, err := sftp.NewClientPipe(clientReader, clientWriter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		// closing the server ends the connection the client is reading from
+		server.Close()
+		client.Close()
+	})
+	return &SFTP{root: root, client: client}, root
+}
+
+func TestSFTPParallelPut(t *testing.T) {
+	s, root := testSFTP(t)
+
+	const files = 16
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, files)
+	)
+	for i := 0; i < files; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := strings.Repeat(fmt.Sprintf("file %d\n", i), 4096)
+			errs[i] = s.Put(fmt.Sprintf("backups/s1/n1/ks/t/file-%d", i), strings.NewReader(body), PutOptions{})
+		}(i)
+	}
+	wg.Wait()
+
+	dir := filepath.Join(root, "backups", "s1", "n1", "ks", "t")
+	for i := 0; i < files; i++ {
+		if errs[i] != nil {
+			t.Fatalf("upload %d failed: %v", i, errs[i])
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, fmt.Sprintf("file-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := strings.Repeat(fmt.Sprintf("file %d\n", i), 4096); !bytes.Equal(data, []byte(expected)) {
+			t.Errorf("file-%d holds %d bytes of other content", i, len(data))
+		}
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), tempFilePrefix) {
+			t.Errorf("temporary file %s was left behind", entry.Name())
+		}
+	}
+}
+
+func TestSFTPCreateTempIsExclusive(t *testing.T) {
+	s, root := testSFTP(t)
+
+	file, name, err := s.createTemp(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if !strings.HasPrefix(filepath.Base(name), tempFilePrefix) {
+		t.Errorf("temporary file %s does not start with %s", name, tempFilePrefix)
+	}
+
+	// opening the same name again must fail instead of truncating it
+	if _, err := s.client.OpenFile(name, sftpTempFlags); err == nil {
+		t.Errorf("temporary file %s was opened a second time", name)
+	}
+}
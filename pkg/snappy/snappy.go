@@ -5,65 +5,284 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/cheggaaa/pb"
 	humanize "github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
 	SnapshotFolderPrefix = "backups"
+	// SharedFolderPrefix holds deduplicated files, stored once under their checksum
+	SharedFolderPrefix = "shared"
 )
 
-// Backup a nodes snapshot to S3
-func Backup(config *AWSConfig, snapshotID string, keyspaces []string) error {
-	var totalSize int64
+// BackupOptions controls how files are uploaded
+type BackupOptions struct {
+	// Keyspaces limits the backup to these keyspaces, all keyspaces are included when empty
+	Keyspaces []string
+	// Dedup stores files once under their checksum in the shared folder, snapshots reference them from their manifest
+	Dedup bool
+	// Parallel is the number of files uploaded at the same time
+	Parallel int
+	// Compression is applied to files while they are uploaded
+	Compression Compression
+	// SmartCompression uploads the files Cassandra already compressed as they are
+	SmartCompression bool
+	// Keyring encrypts every file when it is set
+	Keyring *Keyring
+	// KeepLocal keeps the local snapshot once it was uploaded, it is cleared by default
+	KeepLocal bool
+	// KeepLast keeps the newest local snapshots taken by snappy and clears the older ones
+	KeepLast int
+	// Labels are recorded in the manifest of every node
+	Labels map[string]string
+}
 
-	s3, err := NewS3(config)
+// Backup a nodes snapshot to one or more configured destinations, each file is read
+// from disk once and streamed to all destinations at the same time
+func Backup(configs []*StorageConfig, snapshotID string, options *BackupOptions) error {
+	fanout, err := openFanout(configs)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	cassandra := NewCassandra()
+	nodeIP := cassandra.GetListenAddress()
 
-	_, err = cassandra.CreateSnapshot(snapshotID, keyspaces)
+	// created before the snapshot, commit log segments archived after it hold every later write
+	manifest := NewManifest(cassandra, nodeIP, snapshotID)
+	manifest.Labels = options.Labels
+
+	_, err = cassandra.CreateSnapshot(snapshotID, options.Keyspaces)
 	if err != nil {
 		log.Warn("snapshot already exists, going to continue upload anyway")
 	}
+	schema := captureSchema(cassandra)
 
-	nodeIP := cassandra.GetListenAddress()
 	dataDirs := cassandra.GetDataDirectories()
-	files, err := cassandra.GetSnapshotFiles(snapshotID, nodeIP, "backups", dataDirs)
+	files, err := cassandra.GetSnapshotFiles(snapshotID, nodeIP, SnapshotFolderPrefix, dataDirs)
+	if err != nil {
+		return err
+	}
+
+	totalSize, err := uploadFiles(fanout, manifest, files, options)
 	if err != nil {
 		return err
 	}
 
+	if schema != nil {
+		fanout.WriteSchema(snapshotID, nodeIP, schema, options.Keyring)
+	}
+	fanout.WriteManifest(manifest)
+
+	// only destinations that received every file are marked complete
+	fanout.MarkSnapshotComplete(filepath.Join(SnapshotFolderPrefix, snapshotID), nodeIP)
+
+	// the last ring member to complete the snapshot marks the cluster snapshot complete
+	hostIDs, err := cassandra.GetRingMembers()
+	if err != nil {
+		log.Warnf("unable to list ring members, cluster snapshot will not be marked complete: %v", err)
+	} else {
+		fanout.MarkClusterSnapshotComplete(snapshotID, hostIDs)
+	}
+
+	log.Infoln("uploaded a total size of:", humanize.Bytes(uint64(totalSize)))
+
+	// the local snapshot is kept when a destination is missing files, the next run uploads them again
+	if err := fanout.Err(); err != nil {
+		return err
+	}
+	cleanupSnapshots(cassandra, fanout, nodeIP, snapshotID, options)
+	return nil
+}
+
+// openFanout opens every configured destination, aborting when one of them cannot be reached
+func openFanout(configs []*StorageConfig) (*Fanout, error) {
+	var remotes []*Remote
+
+	if len(configs) == 0 {
+		return nil, errors.New("no backup destination configured")
+	}
+	for _, config := range configs {
+		remote, err := OpenRemote(config)
+		if err != nil {
+			log.Fatalf("destination [%s]: %v", config.Destination, err)
+		}
+		remotes = append(remotes, remote)
+	}
+	return NewFanout(remotes), nil
+}
+
+// uploadResult is the outcome of uploading a single file by a worker
+type uploadResult struct {
+	index    int
+	file     ManifestFile
+	uploaded bool
+	err      error
+}
+
+// uploadFiles sends local files to their keys on every destination with a pool of workers,
+// recording each of them in the manifest, and returns the number of bytes uploaded. Deduplicated
+// files are only uploaded to the destinations that do not store the same content yet. Every file
+// is attempted, an error listing the files that could not be uploaded is returned at the end.
+func uploadFiles(fanout *Fanout, manifest *Manifest, files map[string]string, options *BackupOptions) (int64, error) {
+	var (
+		totalSize, skippedSize int64
+		paths                  = make([]string, 0, len(files))
+		sizes                  = make(map[string]int64, len(files))
+	)
 	for path := range files {
 		fi, e := os.Stat(path)
 		if e != nil {
 			log.Fatal(e)
 		}
 		totalSize += fi.Size()
+		sizes[path] = fi.Size()
+		paths = append(paths, path)
 	}
+	sort.Strings(paths)
 
 	bar := pb.New64(totalSize)
 	bar.SetUnits(pb.U_BYTES)
 	bar.Start()
 	bar.ShowSpeed = true
 
-	for path, key := range files {
-		if err := s3.UploadFile(path, key); err != nil {
-			log.Fatal(err)
+	workers := options.Parallel
+	if workers < 1 {
+		workers = 1
+	}
+	var (
+		wg      sync.WaitGroup
+		jobs    = make(chan int)
+		results = make(chan uploadResult)
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				path := paths[idx]
+				file, uploaded, err := uploadFile(fanout, manifest, path, files[path], sizes[path], options)
+				bar.Add64(sizes[path])
+				results <- uploadResult{index: idx, file: file, uploaded: uploaded, err: err}
+			}
+		}()
+	}
+	go func() {
+		for idx := range paths {
+			jobs <- idx
 		}
-		fi, e := os.Stat(path)
-		if e != nil {
-			log.Fatal(e)
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	// results are reported in the order of the files, whichever worker finishes first
+	var (
+		done   = make([]*uploadResult, len(paths))
+		next   int
+		failed []string
+
+		compressedSize, storedSize int64
+	)
+	for result := range results {
+		result := result
+		done[result.index] = &result
+		for ; next < len(paths) && done[next] != nil; next++ {
+			r := done[next]
+			if r.err != nil {
+				log.Errorf("[%d/%d] failed to upload %s: %v", next+1, len(paths), paths[next], r.err)
+				failed = append(failed, paths[next])
+				continue
+			}
+			log.Debugf("[%d/%d] uploaded %s", next+1, len(paths), r.file.Key)
+			if !r.uploaded {
+				skippedSize += r.file.Size
+			}
+			if r.file.Compression != "" {
+				compressedSize += r.file.Size
+				storedSize += r.file.StoredSize
+			}
+			manifest.Files = append(manifest.Files, r.file)
 		}
-		bar.Add64(fi.Size())
 	}
 	bar.Finish()
-	log.Infoln("uploaded a total size of:", humanize.Bytes(uint64(totalSize)))
-	return nil
+
+	if options.Dedup {
+		log.Infof("%s of files were already stored and not uploaded again", humanize.Bytes(uint64(skippedSize)))
+	}
+	if compressedSize > 0 {
+		log.Infof("compressed %s of files to %s", humanize.Bytes(uint64(compressedSize)), humanize.Bytes(uint64(storedSize)))
+	}
+	if len(failed) > 0 {
+		return totalSize - skippedSize, errors.Errorf("%d of %d files could not be uploaded: %s", len(failed), len(paths), strings.Join(failed, ", "))
+	}
+	return totalSize - skippedSize, nil
+}
+
+// uploadFile sends a local file to every destination and records its checksum, reporting whether it had to be uploaded
+func uploadFile(fanout *Fanout, manifest *Manifest, path, key string, size int64, options *BackupOptions) (ManifestFile, bool, error) {
+	file := newManifestFile(key, size)
+	encoding := Encoding{Compression: options.Compression, Keyring: options.Keyring}
+	if options.SmartCompression && cassandraCompressed(path) {
+		encoding.Compression = Compression{}
+	}
+	file.Compression = encoding.Compression.Codec
+	file.KeyID = encoding.KeyID()
+
+	// the checksum is attached to the object as metadata, so it has to be known before the upload
+	checksum, err := fileChecksum(path)
+	if err != nil {
+		return file, false, err
+	}
+	file.Checksum = checksum
+
+	var (
+		stored   int64
+		uploaded = true
+	)
+	if options.Dedup {
+		// shared objects are named after their checksum
+		name := file.Checksum
+		if file.KeyID != "" {
+			if name, err = encoding.Keyring.SharedName(file.Checksum); err != nil {
+				return file, false, err
+			}
+		}
+		file.Object = sharedObjectKey(name) + encoding.Extension()
+		// shared objects are referenced by many snapshots, they do not carry the snapshot id
+		metadata := manifest.Metadata(file)
+		delete(metadata, MetadataSnapshotID)
+		if file.KeyID != "" {
+			// the checksum of the plaintext would confirm the content of an encrypted object
+			delete(metadata, MetadataChecksum)
+		}
+
+		var keyID string
+		stored, keyID, uploaded, err = fanout.UploadShared(path, file.Object, size, metadata, encoding)
+		if file.KeyID != "" && keyID != "" {
+			// an object that is already stored may have been encrypted with another key of the keyring
+			file.KeyID = keyID
+		}
+	} else {
+		if !encoding.Identity() {
+			file.Object = key + encoding.Extension()
+		}
+		var uploadedChecksum string
+		stored, uploadedChecksum, err = fanout.UploadFile(path, file.ObjectKey(), manifest.Metadata(file), encoding)
+		if err == nil && uploadedChecksum != file.Checksum {
+			err = errors.Errorf("%s changed while it was uploaded", path)
+		}
+	}
+	if !encoding.Identity() {
+		file.StoredSize = stored
+	}
+	return file, uploaded, err
 }
 
 // Prepare a mapping file to be written
@@ -132,8 +351,28 @@ func RestoreApply(dstNode string, mapping *PrepareMapping) {
 	}
 }
 
-// DownloadSnapshot handles copying data from a snapshot on S3 to the local node
-func DownloadSnapshot(dstNode string, snapshotID string, config *AWSConfig, mapping *PrepareMapping, skipTables bool) {
+// DownloadOptions controls how a snapshot is downloaded
+type DownloadOptions struct {
+	// SkipTables ignores tables missing from the local schema instead of aborting
+	SkipTables bool
+	// RestoreDays is how long restored copies of archived objects are kept available
+	RestoreDays int
+	// RestoreTier is the retrieval tier used for archived objects: Expedited, Standard or Bulk
+	RestoreTier string
+	// RestorePollInterval is how often archived objects are checked while they are being restored
+	RestorePollInterval time.Duration
+	// AllowIncomplete restores node or cluster snapshots that were not completely uploaded
+	AllowIncomplete bool
+	// PointInTime also restores archived commit logs, replayed up to this time on the next start
+	PointInTime time.Time
+	// CommitlogDirectory is where archived commit log segments are downloaded to
+	CommitlogDirectory string
+	// Keyring decrypts files that were encrypted, it needs every key used by the snapshot
+	Keyring *Keyring
+}
+
+// DownloadSnapshot handles copying data from a snapshot on the configured storage to the local node
+func DownloadSnapshot(dstNode string, snapshotID string, config *StorageConfig, mapping *PrepareMapping, options *DownloadOptions) {
 	var (
 		srcNode       string
 		snapshotIndex []Snapshot
@@ -153,27 +392,57 @@ func DownloadSnapshot(dstNode string, snapshotID string, config *AWSConfig, mapp
 		log.Fatalf("could not find node: %s in mapping file", dstNode)
 	}
 
-	s3, err := NewS3(config)
+	remote, err := OpenRemote(config)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	snapshotFolder := filepath.Join(SnapshotFolderPrefix, snapshotID, srcNode) + "/"
+	// the manifest lists every keyspace, table and file of the node snapshot,
+	// incremental backups are restored on top of their base snapshot
+	manifests, err := remote.LoadChain(snapshotID, srcNode)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, m := range manifests {
+		if !remote.IsSnapshotComplete(filepath.Join(SnapshotFolderPrefix, m.SnapshotID, srcNode)) {
+			if !options.AllowIncomplete {
+				log.Fatalf("snapshot [%s] was not completely uploaded by node [%s], use --allow-incomplete to restore it anyway", m.SnapshotID, srcNode)
+			}
+			log.Warnf("snapshot [%s] was not completely uploaded by node [%s], restoring anyway", m.SnapshotID, srcNode)
+		}
+	}
+	baseID := manifests[0].SnapshotID
+	if !remote.IsClusterSnapshotComplete(baseID) {
+		if !options.AllowIncomplete {
+			log.Fatalf("snapshot [%s] was not completed by every node in the cluster, use --allow-incomplete to restore it anyway", baseID)
+		}
+		log.Warnf("snapshot [%s] was not completed by every node in the cluster, restoring anyway", baseID)
+	}
+
+	manifest := mergeManifests(manifests)
+	tables := manifest.Tables()
+
+	var keyspaces []string
+	for keyspace := range tables {
+		// do not include system_* keyspaces
+		if !strings.HasPrefix(keyspace, "system") {
+			keyspaces = append(keyspaces, keyspace)
+		}
+	}
+	sort.Strings(keyspaces)
 
-	// find keyspaces associated to this snapshot
-	keyspaces := s3.ListKeyspaces(snapshotFolder)
 	for _, keyspace := range keyspaces {
 		var snapshotTables []SnapshotTable
 
 		// populate tables for each keyspace
-		tables := s3.ListTables(snapshotFolder, keyspace)
-		for _, table := range tables {
+		for _, table := range tables[keyspace] {
 			tableName, srcUUID := Split(table, "-")
 			dstUUID, err := cassandra.FindTableUUID(keyspace, tableName)
 
-			if err != nil && !skipTables {
+			if err != nil && !options.SkipTables {
 				log.Fatalf("tried to locate [keyspace: %s] [table: %s] on local filesystem, but it looks to be missing. check schema to make sure table exists. aborting...", keyspace, tableName)
-			} else if err != nil && skipTables {
+			} else if err != nil && options.SkipTables {
 				log.Warnf("tried to locate [keyspace: %s] [table: %s] on local filesystem, but it looks to be missing. check schema to make sure table exists. skipping...", keyspace, tableName)
 			} else {
 				snapshotTable := &SnapshotTable{
@@ -188,16 +457,42 @@ func DownloadSnapshot(dstNode string, snapshotID string, config *AWSConfig, mapp
 		snapshotIndex = append(snapshotIndex, *snapshot)
 	}
 
+	// collect every file first so archived objects can be restored in one pass
+	var (
+		allFiles    []string
+		remoteFiles = make(map[string][]ManifestFile)
+	)
+	for _, index := range snapshotIndex {
+		for _, table := range index.Tables {
+			files := manifest.TableFiles(index.Keyspace, table.Name, table.SrcUUID)
+			remoteFiles[filepath.Join(index.Keyspace, table.Name)] = files
+			for _, file := range files {
+				allFiles = append(allFiles, file.ObjectKey())
+			}
+		}
+	}
+
+	if err := remote.RestoreArchived(allFiles, options.RestoreDays, options.RestoreTier, options.RestorePollInterval); err != nil {
+		log.Fatal(err)
+	}
+
 	// copy data from bucket to filesystem
 	for _, index := range snapshotIndex {
 		for _, table := range index.Tables {
 			log.Infof("Downloading data to %s/%s", index.Keyspace, table.Name)
-			remoteFiles := s3.ListSnapshotFiles(snapshotFolder, index.Keyspace, table.Name, table.SrcUUID)
 			downloadFolder, err := cassandra.FindTablePath(index.Keyspace, table.Name)
 			if err != nil {
 				log.Fatal(err)
 			}
-			s3.DownloadFiles(snapshotFolder, remoteFiles, downloadFolder)
+			remote.DownloadFiles(remoteFiles[filepath.Join(index.Keyspace, table.Name)], downloadFolder, options.Keyring)
+		}
+	}
+
+	// incremental backups only hold flushed sstables, writes still in memtables when they were
+	// taken are in segments archived since the base snapshot, which flushed everything
+	if !options.PointInTime.IsZero() {
+		if err := RestoreCommitlogs(remote, cassandra, srcNode, manifests[0].CreatedAt, options.PointInTime, options.CommitlogDirectory, options.Keyring); err != nil {
+			log.Fatal(err)
 		}
 	}
 
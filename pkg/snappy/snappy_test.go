@@ -0,0 +1,213 @@
+package snappy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// writeSSTable writes the components of an SSTable to dir, with a Digest.crc32 and CRC.db matching its Data.db
+func writeSSTable(t *testing.T, dir, name string, data []byte) {
+	t.Helper()
+	var crc bytes.Buffer
+	binary.Write(&crc, binary.BigEndian, int32(64))
+	for rest := data; len(rest) > 0; {
+		n := 64
+		if n > len(rest) {
+			n = len(rest)
+		}
+		binary.Write(&crc, binary.BigEndian, crc32.ChecksumIEEE(rest[:n]))
+		rest = rest[n:]
+	}
+	components := map[string][]byte{
+		"Data.db":       data,
+		"Index.db":      []byte("index of " + name),
+		"Statistics.db": []byte("statistics of " + name),
+		"Digest.crc32":  []byte(strconv.FormatUint(uint64(crc32.ChecksumIEEE(data)), 10)),
+		"CRC.db":        crc.Bytes(),
+		"TOC.txt":       []byte("Data.db\nIndex.db\nStatistics.db\nDigest.crc32\nCRC.db\nTOC.txt\n"),
+	}
+	for component, content := range components {
+		if err := ioutil.WriteFile(filepath.Join(dir, name+"-"+component), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// testNodetool answers the nodetool commands a backup runs for a single node cluster,
+// snapshots hardlink the files of every table like Cassandra does
+const testNodetool = `#!/bin/sh
+data="$(dirname "$0")/data"
+case "$1" in
+snapshot)
+  for table in "$data"/*/*; do
+    if [ -d "$table/snapshots/$3" ]; then exit 2; fi
+    mkdir -p "$table/snapshots/$3"
+    for f in "$table"/*; do
+      if [ -f "$f" ]; then ln "$f" "$table/snapshots/$3/"; fi
+    done
+  done;;
+clearsnapshot)
+  rm -rf "$data"/*/*/snapshots/"$3";;
+info)
+  echo "ID                     : host-1"
+  echo "Data Center            : dc1"
+  echo "Rack                   : rack1"
+  echo "Token                  : 100";;
+version)
+  echo "ReleaseVersion: 3.11.4";;
+status)
+  echo "Datacenter: dc1"
+  echo "--  Address   Load   Tokens  Owns    Host ID  Rack"
+  echo "UN  10.0.0.1  1 MiB  1       100.0%  host-1   rack1";;
+esac
+`
+
+const testCqlsh = `#!/bin/sh
+echo "CREATE KEYSPACE ks1 WITH replication = {'class': 'NetworkTopologyStrategy', 'dc1': '3'};"
+echo "CREATE TABLE ks1.t1 (id int PRIMARY KEY);"
+`
+
+// testCassandra installs a cassandra.yaml, nodetool and cqlsh for a node 10.0.0.1 of cluster test
+// and returns the directory of its table ks1.t1
+func testCassandra(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	table := filepath.Join(dir, "data", "ks1", "t1-aaa")
+	if err := os.MkdirAll(table, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"cassandra.yaml": "cluster_name: test\nlisten_address: 10.0.0.1\ndata_file_directories:\n  - " + filepath.Join(dir, "data") + "\n",
+		"nodetool":       testNodetool,
+		"cqlsh":          testCqlsh,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	paths := searchPaths
+	searchPaths = []string{dir}
+	t.Cleanup(func() { searchPaths = paths })
+	return table
+}
+
+func TestBackupVerify(t *testing.T) {
+	tests := []struct {
+		name    string
+		options func(t *testing.T) *BackupOptions
+	}{
+		{"plain files", func(t *testing.T) *BackupOptions { return &BackupOptions{Parallel: 2} }},
+		{"deduplicated", func(t *testing.T) *BackupOptions { return &BackupOptions{Parallel: 2, Dedup: true} }},
+		{"deduplicated, compressed and encrypted", func(t *testing.T) *BackupOptions {
+			return &BackupOptions{
+				Parallel:    2,
+				Dedup:       true,
+				Compression: Compression{Codec: CodecZstd},
+				Keyring:     testKeyring(t, testKey(t)),
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				options = tt.options(t)
+				table   = testCassandra(t)
+				root    = t.TempDir()
+				config  = &StorageConfig{Destination: "file://" + root}
+			)
+			remote, err := OpenRemote(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the second snapshot shares mc-1 with the first one and adds mc-2
+			writeSSTable(t, table, "mc-1-big", bytes.Repeat([]byte("first sstable "), 50))
+			if err := Backup([]*StorageConfig{config}, "s1", options); err != nil {
+				t.Fatal(err)
+			}
+			writeSSTable(t, table, "mc-2-big", bytes.Repeat([]byte("second sstable "), 50))
+			if err := Backup([]*StorageConfig{config}, "s2", options); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, id := range []string{"s1", "s2"} {
+				if !remote.IsClusterSnapshotComplete(id) {
+					t.Errorf("snapshot %s was not marked complete", id)
+				}
+				if _, err := os.Stat(filepath.Join(table, "snapshots", id)); !os.IsNotExist(err) {
+					t.Errorf("local snapshot %s was not cleared: %v", id, err)
+				}
+			}
+			manifest, err := remote.ReadManifest("s2", "10.0.0.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if manifest.Cluster != "test" || manifest.Node.HostID != "host-1" || len(manifest.Files) != 12 {
+				t.Fatalf("manifest of s2 is for cluster %q, host %q with %d files, expected test, host-1 and 12 files",
+					manifest.Cluster, manifest.Node.HostID, len(manifest.Files))
+			}
+			schema, err := SnapshotSchema(config, "s2", "10.0.0.1", &SchemaOptions{Keyring: options.Keyring})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(schema, "CREATE KEYSPACE IF NOT EXISTS ks1") {
+				t.Errorf("schema of s2 does not create ks1:\n%s", schema)
+			}
+
+			if options.Dedup {
+				// the files of mc-1 are stored once for both snapshots, and both SSTables have the same TOC.txt
+				shared, err := remote.storage.List(SharedFolderPrefix+"/", "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(shared.Objects) != 11 {
+					t.Errorf("%d shared objects are stored, expected 11", len(shared.Objects))
+				}
+			}
+
+			verifyOptions := &VerifyOptions{Deep: true, Keyring: options.Keyring, Parallel: 2}
+			for _, id := range []string{"s1", "s2"} {
+				report, err := Verify(config, id, verifyOptions)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !report.OK() || report.Files == 0 {
+					t.Fatalf("snapshot %s failed verification of %d files: %+v", id, report.Files, report.Failed)
+				}
+			}
+
+			// a corrupt Data.db is found by its size, checksum and SSTable digests
+			for _, file := range manifest.Files {
+				if file.Component != "Data.db" {
+					continue
+				}
+				if err := ioutil.WriteFile(filepath.Join(root, filepath.FromSlash(file.ObjectKey())), []byte("corrupt"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			report, err := Verify(config, "s2", verifyOptions)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(report.Failed) != 2 {
+				t.Errorf("%d files failed verification, expected the 2 Data.db: %+v", len(report.Failed), report.Failed)
+			}
+
+			if err := os.Remove(filepath.Join(root, "backups", "s2", "10.0.0.1", SnapshotCompleted)); err != nil {
+				t.Fatal(err)
+			}
+			if report, _ := Verify(config, "s2", &VerifyOptions{Parallel: 1}); report.OK() {
+				t.Error("snapshot without its completion marker passed verification")
+			}
+		})
+	}
+}
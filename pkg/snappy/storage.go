@@ -0,0 +1,150 @@
+package snappy
+
+import (
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNotExist is returned by a Storage backend when a key could not be found
+var ErrNotExist = errors.New("object does not exist")
+
+// Storage is a backup destination that snapshots are written to and restored from.
+// Keys are always slash separated and relative to the root of the destination.
+type Storage interface {
+	// Put streams body to the object at key, replacing any existing object
+	Put(key string, body io.Reader, opts PutOptions) error
+	// Get opens the object at key for reading
+	Get(key string) (io.ReadCloser, error)
+	// Head returns the attributes of the object at key
+	Head(key string) (*ObjectInfo, error)
+	// List returns the objects found under prefix. When delimiter is set, keys
+	// containing the delimiter after the prefix are rolled up into Prefixes.
+	List(prefix string, delimiter string) (*Listing, error)
+	// Delete removes the object at key
+	Delete(key string) error
+}
+
+// Copier is implemented by backends that can copy objects from another backend
+// without streaming them through snappy
+type Copier interface {
+	// Copy copies srcKey from src to dstKey, returning false when it cannot be done server side
+	Copy(src Storage, srcKey, dstKey string, size int64, opts PutOptions) (bool, error)
+}
+
+// Archiver is implemented by backends with archive tiers, where objects have to be
+// restored to a readable copy before they can be downloaded
+type Archiver interface {
+	// Restore requests a readable copy of an archived object for days, using a
+	// backend specific retrieval tier. It reports whether the object can be read now.
+	Restore(key string, days int, tier string) (bool, error)
+}
+
+// PutOptions describes how an object should be stored
+type PutOptions struct {
+	// StorageClass is a backend specific tier such as STANDARD_IA or GLACIER,
+	// backends without storage classes ignore it
+	StorageClass string
+	// Metadata is stored with the object as user metadata, backends without
+	// object metadata ignore it
+	Metadata map[string]string
+}
+
+// ObjectInfo describes a single object on a Storage backend
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	// Metadata is filled in by Head, and by List on backends that return it with listings
+	Metadata map[string]string
+}
+
+// Listing is the result of listing a prefix on a Storage backend
+type Listing struct {
+	Objects  []ObjectInfo
+	Prefixes []string
+}
+
+// StorageConfig describes where backups are stored and how to reach them
+type StorageConfig struct {
+	// Destination is a url such as s3://bucket/prefix, gs://bucket/prefix,
+	// az://account/container/prefix, sftp://user@host:port/path or file:///mnt/backups
+	Destination string
+	// StorageClass is used for uploaded files, small files are always kept in the default class
+	StorageClass string
+	AWS          AWSConfig
+	GCS          GCSConfig
+	Azure        AzureConfig
+	SFTP         SFTPConfig
+}
+
+// NewStorage returns the Storage backend matching the scheme of the destination url
+func NewStorage(config *StorageConfig) (Storage, error) {
+	u, err := url.Parse(config.Destination)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid destination [%s]", config.Destination)
+	}
+
+	switch u.Scheme {
+	case "s3":
+		aws := config.AWS
+		aws.Bucket = u.Host
+		aws.Prefix = strings.Trim(u.Path, "/")
+		return NewS3(&aws)
+	case "gs":
+		gcs := config.GCS
+		gcs.Bucket = u.Host
+		gcs.Prefix = strings.Trim(u.Path, "/")
+		return NewGCS(&gcs)
+	case "az":
+		azure := config.Azure
+		azure.Account = u.Host
+		azure.Container, azure.Prefix = Split(strings.Trim(u.Path, "/"), "/")
+		if azure.Container == "" {
+			return nil, errors.Errorf("destination [%s] is missing a container", config.Destination)
+		}
+		return NewAzure(&azure)
+	case "sftp":
+		sftp := config.SFTP
+		sftp.Host = u.Hostname()
+		if u.User != nil {
+			sftp.User = u.User.Username()
+		}
+		if port := u.Port(); port != "" {
+			sftp.Port, err = strconv.Atoi(port)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid port in destination [%s]", config.Destination)
+			}
+		}
+		sftp.Root = u.Path
+		return NewSFTP(&sftp)
+	case "file":
+		// file://mnt/backups parses mnt as a host, only local paths are supported
+		if u.Host != "" && u.Host != "localhost" {
+			return nil, errors.Errorf("destination [%s] names host [%s], use file:///path for a local directory", config.Destination, u.Host)
+		}
+		return NewFilesystem(u.Path)
+	default:
+		return nil, errors.Errorf("unsupported destination [%s]", config.Destination)
+	}
+}
+
+// joinKey joins a backend prefix and a key into a slash separated object name
+func joinKey(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return strings.TrimSuffix(prefix, "/") + "/" + strings.TrimPrefix(key, "/")
+}
+
+// trimKey removes a backend prefix from an object name
+func trimKey(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return strings.TrimPrefix(key, strings.TrimSuffix(prefix, "/")+"/")
+}
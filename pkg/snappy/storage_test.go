@@ -0,0 +1,27 @@
+package snappy
+
+import "testing"
+
+func TestNewStorageFile(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		destination string
+		valid       bool
+	}{
+		{"file://" + dir, true},
+		{"file://localhost" + dir, true},
+		{"file://mnt/backups", false},
+		{"file://backup-host" + dir, false},
+		{"file://" + dir + "/missing", false},
+	}
+	for _, tt := range tests {
+		storage, err := NewStorage(&StorageConfig{Destination: tt.destination})
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: valid is %t, expected %t (%v)", tt.destination, err == nil, tt.valid, err)
+			continue
+		}
+		if err == nil && storage.(*Filesystem).root != dir {
+			t.Errorf("%s: stores backups in %s, expected %s", tt.destination, storage.(*Filesystem).root, dir)
+		}
+	}
+}
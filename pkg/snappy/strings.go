@@ -17,3 +17,13 @@ func Split(s, sep string) (string, string) {
 
 	return slice[0], slice[1]
 }
+
+// contains reports whether s is in list
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
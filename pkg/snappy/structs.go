@@ -26,3 +26,11 @@ type SnapshotTable struct {
 	SrcUUID string
 	DstUUID string
 }
+
+// NodeInfo is the identity and tokens of the local node, as reported by nodetool info
+type NodeInfo struct {
+	HostID     string
+	Datacenter string
+	Rack       string
+	Tokens     []string
+}
@@ -0,0 +1,360 @@
+package snappy
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/adler32"
+	"hash/crc32"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// digestComponents are the whole file checksums Cassandra writes next to the Data.db of an SSTable,
+// the digest is the decimal value of the crc32 or adler32, or the hex encoded sha1 of older versions
+var digestComponents = map[string]func() hash.Hash{
+	"Digest.crc32":   func() hash.Hash { return crc32.NewIEEE() },
+	"Digest.adler32": func() hash.Hash { return adler32.New() },
+	"Digest.sha1":    sha1.New,
+}
+
+// VerifyOptions controls how thoroughly a snapshot is verified
+type VerifyOptions struct {
+	// Deep downloads every object to recompute its checksum and the SSTable digests
+	Deep bool
+	// Keyring decrypts encrypted objects in deep mode
+	Keyring *Keyring
+	// Parallel is the number of files verified at the same time
+	Parallel int
+}
+
+// VerifyReport lists the files of a snapshot that failed verification
+type VerifyReport struct {
+	SnapshotID string `json:"snapshot_id"`
+	Deep       bool   `json:"deep"`
+	Files      int    `json:"files"`
+	// Bytes is the size of the files that were read back and matched in deep mode
+	Bytes  int64          `json:"bytes"`
+	Failed []VerifyResult `json:"failed"`
+}
+
+// VerifyResult is a file, or a marker or manifest, of a snapshot with what is wrong with it
+type VerifyResult struct {
+	Node     string   `json:"node"`
+	Key      string   `json:"key"`
+	Object   string   `json:"object,omitempty"`
+	Problems []string `json:"problems"`
+}
+
+// OK reports whether every file of the snapshot was verified
+func (v *VerifyReport) OK() bool {
+	return len(v.Failed) == 0
+}
+
+// Verify checks every file in the manifests of a snapshot exists with the expected size and checksum.
+// In deep mode the objects are read back and decoded, their sha256 is recomputed and the Data.db of
+// every SSTable is checked against its Digest and CRC.db components.
+func Verify(config *StorageConfig, snapshotID string, options *VerifyOptions) (*VerifyReport, error) {
+	remote, err := OpenRemote(config)
+	if err != nil {
+		return nil, err
+	}
+	nodes := remote.ListNodes(snapshotID)
+	if len(nodes) == 0 {
+		return nil, errors.Errorf("snapshot [%s] does not exist on [%s]", snapshotID, remote)
+	}
+
+	report := &VerifyReport{SnapshotID: snapshotID, Deep: options.Deep, Failed: []VerifyResult{}}
+	for _, node := range nodes {
+		manifest, err := remote.ReadManifest(snapshotID, node)
+		if err == ErrNotExist {
+			log.Warnf("node [%s] has no manifest, its files are verified from a listing without checksums", node)
+			manifest, err = remote.LoadManifest(snapshotID, node)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		marker := filepath.Join(SnapshotFolderPrefix, snapshotID, node)
+		if !remote.IsSnapshotComplete(marker) {
+			report.fail(node, filepath.Join(marker, SnapshotCompleted), "completion marker is missing, the node did not finish uploading")
+		}
+		if manifest.Base != "" {
+			remote.verifyChain(report, snapshotID, node, manifest.Base)
+		}
+
+		log.Infof("verifying %d files of node [%s]", len(manifest.Files), node)
+		results := remote.verifyFiles(manifest, options)
+		for i, problems := range results {
+			report.Files++
+			if options.Deep && len(problems) == 0 {
+				report.Bytes += fileSize(manifest.Files[i])
+			}
+			if len(problems) > 0 {
+				file := manifest.Files[i]
+				report.Failed = append(report.Failed, VerifyResult{Node: node, Key: file.Key, Object: file.Object, Problems: problems})
+			}
+		}
+	}
+
+	log.Infof("verified %d files (%s read back) of snapshot [%s], %d problems found",
+		report.Files, humanize.Bytes(uint64(report.Bytes)), snapshotID, len(report.Failed))
+	return report, nil
+}
+
+// verifyChain checks the base snapshot and every earlier incremental backup an incremental backup
+// of a node builds on is recorded in the chain and was completed, a restore needs all of them
+func (r *Remote) verifyChain(report *VerifyReport, snapshotID, node, baseID string) {
+	chain, err := r.LoadChain(snapshotID, node)
+	if err != nil {
+		report.fail(node, chainKey(baseID, node), fmt.Sprintf("chain of base snapshot [%s] cannot be read: %v", baseID, err))
+		return
+	}
+	for _, link := range chain[:len(chain)-1] {
+		if !r.IsSnapshotComplete(filepath.Join(SnapshotFolderPrefix, link.SnapshotID, node)) {
+			report.fail(node, filepath.Join(SnapshotFolderPrefix, link.SnapshotID, node, SnapshotCompleted),
+				fmt.Sprintf("snapshot [%s] of the chain is missing or incomplete", link.SnapshotID))
+		}
+	}
+}
+
+// fail records a problem with an object that is not a file of the manifest
+func (v *VerifyReport) fail(node, key, problem string) {
+	v.Failed = append(v.Failed, VerifyResult{Node: node, Key: key, Problems: []string{problem}})
+}
+
+// verifyFiles verifies the files of a manifest with a pool of workers, returning the problems of each file
+func (r *Remote) verifyFiles(manifest *Manifest, options *VerifyOptions) [][]string {
+	files := make(map[string]ManifestFile, len(manifest.Files))
+	for _, file := range manifest.Files {
+		files[file.Key] = file
+	}
+
+	workers := options.Parallel
+	if workers < 1 {
+		workers = 1
+	}
+	var (
+		wg      sync.WaitGroup
+		jobs    = make(chan int)
+		results = make([][]string, len(manifest.Files))
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				results[idx] = r.verifyFile(manifest.Files[idx], files, options)
+			}
+		}()
+	}
+	for idx := range manifest.Files {
+		jobs <- idx
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
+
+// verifyFile checks a file against its object, files holds the other files of the node
+// snapshot so the Data.db of an SSTable can be checked against its digest components
+func (r *Remote) verifyFile(file ManifestFile, files map[string]ManifestFile, options *VerifyOptions) []string {
+	key := file.ObjectKey()
+	info, err := r.storage.Head(key)
+	if err == ErrNotExist {
+		return []string{"object is missing"}
+	}
+	if err != nil {
+		return []string{fmt.Sprintf("unable to read object: %v", err)}
+	}
+
+	var problems []string
+	if size := file.ObjectSize(); size >= 0 && info.Size != size {
+		problems = append(problems, fmt.Sprintf("object size is %d, expected %d", info.Size, size))
+	}
+	checksum := file.Checksum
+	if stored := info.Metadata[MetadataChecksum]; stored != "" {
+		if checksum != "" && stored != checksum {
+			problems = append(problems, fmt.Sprintf("object metadata checksum is %s, expected %s", stored, checksum))
+		}
+		if checksum == "" {
+			checksum = stored
+		}
+	}
+	if !options.Deep {
+		return problems
+	}
+
+	var checks []*sstableCheck
+	if strings.HasSuffix(file.Key, "-Data.db") {
+		prefix := strings.TrimSuffix(file.Key, "Data.db")
+		for component, newHash := range digestComponents {
+			if digest, ok := files[prefix+component]; ok {
+				c, err := r.digestCheck(component, digest, newHash, options.Keyring)
+				if err != nil {
+					problems = append(problems, err.Error())
+					continue
+				}
+				checks = append(checks, c)
+			}
+		}
+		if crc, ok := files[prefix+"CRC.db"]; ok {
+			c, err := r.chunkCheck(crc, options.Keyring)
+			if err != nil {
+				problems = append(problems, err.Error())
+			} else {
+				checks = append(checks, c)
+			}
+		}
+	}
+
+	return append(problems, r.readBack(file, checksum, checks, options.Keyring)...)
+}
+
+// readBack downloads and decodes the object of a file, comparing its size, sha256 and SSTable digests
+func (r *Remote) readBack(file ManifestFile, checksum string, checks []*sstableCheck, keyring *Keyring) []string {
+	body, err := r.storage.Get(file.ObjectKey())
+	if err != nil {
+		return []string{fmt.Sprintf("unable to download object: %v", err)}
+	}
+	defer body.Close()
+
+	reader, err := decodeReader(NetworkLimiter.Reader(body), file.Compression, file.KeyID, keyring)
+	if err != nil {
+		return []string{fmt.Sprintf("unable to decode object: %v", err)}
+	}
+	defer reader.Close()
+
+	sum := sha256.New()
+	writers := []io.Writer{sum}
+	for _, c := range checks {
+		writers = append(writers, c.hash)
+	}
+	size, err := io.Copy(io.MultiWriter(writers...), reader)
+	if err != nil {
+		return []string{fmt.Sprintf("unable to read object back: %v", err)}
+	}
+
+	var problems []string
+	if file.Size >= 0 && size != file.Size {
+		problems = append(problems, fmt.Sprintf("decoded size is %d, expected %d", size, file.Size))
+	}
+	if actual := hex.EncodeToString(sum.Sum(nil)); checksum != "" && actual != checksum {
+		problems = append(problems, fmt.Sprintf("sha256 is %s, expected %s", actual, checksum))
+	}
+	for _, c := range checks {
+		if problem := c.verify(); problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+	return problems
+}
+
+// sstableCheck compares the Data.db of an SSTable with one of its checksum components
+type sstableCheck struct {
+	hash   io.Writer
+	verify func() string
+}
+
+// digestCheck reads a Digest component, the checksum of the whole Data.db
+func (r *Remote) digestCheck(component string, digest ManifestFile, newHash func() hash.Hash, keyring *Keyring) (*sstableCheck, error) {
+	data, err := r.readFile(digest, keyring)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read %s", component)
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return nil, errors.Errorf("%s is empty", component)
+	}
+	expected := fields[0]
+
+	h := newHash()
+	return &sstableCheck{hash: h, verify: func() string {
+		actual := hex.EncodeToString(h.Sum(nil))
+		if h32, ok := h.(hash.Hash32); ok {
+			actual = strconv.FormatUint(uint64(h32.Sum32()), 10)
+		}
+		if actual != expected {
+			return fmt.Sprintf("%s is %s, expected %s", component, actual, expected)
+		}
+		return ""
+	}}, nil
+}
+
+// chunkCheck reads a CRC.db component, the chunk size followed by the crc32 of every chunk of an uncompressed Data.db
+func (r *Remote) chunkCheck(crc ManifestFile, keyring *Keyring) (*sstableCheck, error) {
+	data, err := r.readFile(crc, keyring)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read CRC.db")
+	}
+	if len(data) < 4 || len(data)%4 != 0 {
+		return nil, errors.New("CRC.db is truncated")
+	}
+	chunkSize := int(binary.BigEndian.Uint32(data))
+	if chunkSize <= 0 {
+		return nil, errors.Errorf("CRC.db has an invalid chunk size %d", chunkSize)
+	}
+	var expected []uint32
+	for i := 4; i < len(data); i += 4 {
+		expected = append(expected, binary.BigEndian.Uint32(data[i:]))
+	}
+
+	w := &chunkWriter{size: chunkSize, crc: crc32.NewIEEE()}
+	return &sstableCheck{hash: w, verify: func() string {
+		actual := w.sums()
+		if len(actual) != len(expected) {
+			return fmt.Sprintf("Data.db has %d chunks, CRC.db has %d", len(actual), len(expected))
+		}
+		for i := range actual {
+			if actual[i] != expected[i] {
+				return fmt.Sprintf("chunk %d does not match its crc in CRC.db", i)
+			}
+		}
+		return ""
+	}}, nil
+}
+
+// chunkWriter computes the crc32 of every chunk of size bytes written to it
+type chunkWriter struct {
+	size    int
+	written int
+	crc     hash.Hash32
+	crcs    []uint32
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	total := len(p)
+	for len(p) > 0 {
+		n := w.size - w.written
+		if n > len(p) {
+			n = len(p)
+		}
+		w.crc.Write(p[:n])
+		w.written += n
+		p = p[n:]
+		if w.written == w.size {
+			w.crcs = append(w.crcs, w.crc.Sum32())
+			w.crc.Reset()
+			w.written = 0
+		}
+	}
+	return total, nil
+}
+
+// sums returns the crc32 of every chunk, including the last partial one
+func (w *chunkWriter) sums() []uint32 {
+	if w.written > 0 {
+		return append(w.crcs, w.crc.Sum32())
+	}
+	return w.crcs
+}
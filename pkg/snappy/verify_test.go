@@ -0,0 +1,158 @@
+package snappy
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/adler32"
+	"hash/crc32"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// putObject stores data at key on a remote and describes it as a file of a manifest
+func putObject(t *testing.T, remote *Remote, key string, data []byte) ManifestFile {
+	t.Helper()
+	if err := remote.storage.Put(key, bytes.NewReader(data), PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	return ManifestFile{Key: key, Size: int64(len(data))}
+}
+
+// crcFile returns a CRC.db holding the chunk size and the crc32 of every chunk of data
+func crcFile(data []byte, chunkSize int) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, int32(chunkSize))
+	for len(data) > 0 {
+		n := chunkSize
+		if n > len(data) {
+			n = len(data)
+		}
+		binary.Write(&b, binary.BigEndian, crc32.ChecksumIEEE(data[:n]))
+		data = data[n:]
+	}
+	return b.Bytes()
+}
+
+func TestChunkWriter(t *testing.T) {
+	data := []byte("0123456789abcdefghij")
+
+	tests := []struct {
+		name   string
+		data   []byte
+		size   int
+		writes []int
+		want   []uint32
+	}{
+		{"empty", nil, 4, nil, nil},
+		{"partial last chunk", data[:10], 4, []int{10}, []uint32{
+			crc32.ChecksumIEEE(data[0:4]), crc32.ChecksumIEEE(data[4:8]), crc32.ChecksumIEEE(data[8:10]),
+		}},
+		{"exact multiple of the chunk size", data[:12], 4, []int{12}, []uint32{
+			crc32.ChecksumIEEE(data[0:4]), crc32.ChecksumIEEE(data[4:8]), crc32.ChecksumIEEE(data[8:12]),
+		}},
+		{"writes across chunk boundaries", data, 8, []int{3, 7, 1, 9}, []uint32{
+			crc32.ChecksumIEEE(data[0:8]), crc32.ChecksumIEEE(data[8:16]), crc32.ChecksumIEEE(data[16:20]),
+		}},
+		{"chunk larger than the data", data, 64, []int{20}, []uint32{crc32.ChecksumIEEE(data)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &chunkWriter{size: tt.size, crc: crc32.NewIEEE()}
+			rest := tt.data
+			for _, n := range tt.writes {
+				written, err := w.Write(rest[:n])
+				if err != nil || written != n {
+					t.Fatalf("wrote %d of %d bytes: %v", written, n, err)
+				}
+				rest = rest[n:]
+			}
+			if got := w.sums(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("chunk crcs are %v, expected %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDigestCheck(t *testing.T) {
+	remote := testRemote(t)
+	data := []byte("sstable data written by cassandra")
+	sha := sha1.Sum(data)
+
+	tests := []struct {
+		name      string
+		component string
+		digest    string
+		data      []byte
+		valid     bool
+	}{
+		{"crc32 as decimal", "Digest.crc32", strconv.FormatUint(uint64(crc32.ChecksumIEEE(data)), 10) + "\n", data, true},
+		{"adler32 as decimal", "Digest.adler32", strconv.FormatUint(uint64(adler32.Checksum(data)), 10), data, true},
+		{"sha1 as hex followed by the file name", "Digest.sha1", hex.EncodeToString(sha[:]) + "  mc-1-big-Data.db\n", data, true},
+		{"crc32 mismatch", "Digest.crc32", strconv.FormatUint(uint64(crc32.ChecksumIEEE(data)), 10), []byte("other data"), false},
+		{"sha1 mismatch", "Digest.sha1", hex.EncodeToString(sha[:]), data[1:], false},
+		{"crc32 written as hex", "Digest.crc32", hex.EncodeToString(crc32.NewIEEE().Sum(nil)), data, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			digest := putObject(t, remote, "backups/s1/10.0.0.1/ks1/t1-aaa/mc-1-big-"+tt.component, []byte(tt.digest))
+			check, err := remote.digestCheck(tt.component, digest, digestComponents[tt.component], nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			check.hash.Write(tt.data)
+			if problem := check.verify(); (problem == "") != tt.valid {
+				t.Errorf("problem is %q, expected valid %t", problem, tt.valid)
+			}
+		})
+	}
+
+	empty := putObject(t, remote, "backups/s1/10.0.0.1/ks1/t1-aaa/mc-2-big-Digest.crc32", []byte("\n"))
+	if _, err := remote.digestCheck("Digest.crc32", empty, digestComponents["Digest.crc32"], nil); err == nil {
+		t.Error("an empty digest was accepted")
+	}
+}
+
+func TestChunkCheck(t *testing.T) {
+	remote := testRemote(t)
+	data := bytes.Repeat([]byte("partition "), 100)
+
+	tests := []struct {
+		name  string
+		crc   []byte
+		data  []byte
+		valid bool
+	}{
+		{"matching chunks", crcFile(data, 64), data, true},
+		{"exact multiple of the chunk size", crcFile(data, 100), data, true},
+		{"corrupt chunk", crcFile(data, 64), append(append([]byte(nil), data[:500]...), bytes.Repeat([]byte("x"), 500)...), false},
+		{"data is longer than the crcs", crcFile(data[:640], 64), data, false},
+		{"data is shorter than the crcs", crcFile(data, 64), data[:640], false},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			crc := putObject(t, remote, "backups/s1/10.0.0.1/ks1/t1-aaa/mc-"+strconv.Itoa(i)+"-big-CRC.db", tt.crc)
+			check, err := remote.chunkCheck(crc, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			check.hash.Write(tt.data)
+			if problem := check.verify(); (problem == "") != tt.valid {
+				t.Errorf("problem is %q, expected valid %t", problem, tt.valid)
+			}
+		})
+	}
+
+	for name, crc := range map[string][]byte{
+		"truncated":          crcFile(data, 64)[:6],
+		"invalid chunk size": {0, 0, 0, 0},
+		"empty":              {},
+	} {
+		file := putObject(t, remote, "backups/s1/10.0.0.1/ks1/t1-aaa/mc-9-big-CRC.db", crc)
+		if _, err := remote.chunkCheck(file, nil); err == nil {
+			t.Errorf("%s CRC.db was accepted", name)
+		}
+	}
+}